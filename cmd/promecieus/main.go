@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -52,18 +56,96 @@ func main() {
 		Cookie: os.Getenv("GRAFANA_COOKIE"),
 	}
 
+	fetcherSettings := promecieus.DefaultFetcherSettings()
+	if retries, err := strconv.Atoi(os.Getenv("FETCH_RETRIES")); err == nil {
+		fetcherSettings.Retries = retries
+	}
+	if concurrency, err := strconv.Atoi(os.Getenv("FETCH_HOST_CONCURRENCY")); err == nil {
+		fetcherSettings.HostConcurrency = concurrency
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("FETCH_TIMEOUT")); err == nil {
+		fetcherSettings.Timeout = timeout
+	}
+	fetcher := promecieus.NewFetcher(fetcherSettings)
+
 	server := &promecieus.ServerSettings{
 		K8sClient:   k8sC,
-		RouteClient: routeC,
 		Namespace:   namespace,
 		RQuotaName:  rquotaName,
 		RQStatus:    &rqStatus,
 		Conns:       &promecieus.OpenSockets{},
 		Datasources: make(map[string]int),
+		Annotations: make(map[string][]int),
 		Grafana:     &grafana,
+		Resolvers:   promecieus.DefaultResolvers(fetcher),
+		Selections:  &promecieus.PendingSelections{},
+		Creations:   &promecieus.PendingCreations{},
+		Instances:   &promecieus.InstanceStreams{},
+		References:  &promecieus.InstanceReferences{},
+		Fetcher:     fetcher,
 	}
 
 	ctx := context.Background()
+	s3Settings := promecieus.S3Settings{
+		Endpoint: os.Getenv("S3_ENDPOINT"),
+		Region:   os.Getenv("S3_REGION"),
+	}
+	if s3SecretName := os.Getenv("S3_CREDENTIALS_SECRET"); len(s3SecretName) != 0 {
+		if s3Settings, err = promecieus.S3SettingsFromSecret(ctx, k8sC, namespace, s3SecretName, s3Settings); err != nil {
+			klog.Fatalf("Failed to read S3 settings: %v", err)
+		}
+	}
+	server.Resolvers.Register(promecieus.NewS3Resolver(fetcher, s3Settings))
+
+	// Default directory is in the container writable layer, so only a small amount of data is staged there.
+	// Deployment manifests mount an emptyDir at STAGING_DIR and raise the limit accordingly
+	staging := &promecieus.Staging{
+		Dir:         filepath.Join(os.TempDir(), "promecieus-staging"),
+		SizeLimit:   1 << 30,
+		TTL:         time.Hour,
+		InternalURL: fmt.Sprintf("http://promecieus.%s.svc:8080", namespace),
+	}
+	if stagingDir := os.Getenv("STAGING_DIR"); len(stagingDir) != 0 {
+		staging.Dir = stagingDir
+	}
+	if sizeLimit, err := strconv.ParseInt(os.Getenv("STAGING_SIZE_LIMIT"), 10, 64); err == nil {
+		staging.SizeLimit = sizeLimit
+	}
+	if internalURL := os.Getenv("INTERNAL_URL"); len(internalURL) != 0 {
+		staging.InternalURL = internalURL
+	}
+	server.Staging = staging
+	server.Resolvers.Register(staging)
+
+	templates, err := promecieus.LoadManifestTemplates(ctx, k8sC, namespace)
+	if err != nil {
+		klog.Fatalf("Failed to load manifest templates: %v", err)
+	}
+	server.Templates = templates
+	go server.WatchManifestTemplates(ctx)
+
+	exposure := promecieus.ExposureSettings{
+		Kind:             os.Getenv("EXPOSURE"),
+		Host:             os.Getenv("EXPOSURE_HOST"),
+		Scheme:           os.Getenv("EXPOSURE_SCHEME"),
+		TLSTermination:   "edge",
+		IngressClass:     os.Getenv("INGRESS_CLASS"),
+		TLSSecret:        os.Getenv("INGRESS_TLS_SECRET"),
+		Gateway:          os.Getenv("GATEWAY_NAME"),
+		GatewayNamespace: os.Getenv("GATEWAY_NAMESPACE"),
+		GatewaySection:   os.Getenv("GATEWAY_SECTION"),
+		PublicURL:        os.Getenv("PUBLIC_URL"),
+	}
+	if tlsTermination, ok := os.LookupEnv("ROUTE_TLS_TERMINATION"); ok {
+		exposure.TLSTermination = tlsTermination
+	}
+	exposer, err := promecieus.NewExposer(kubeConfigEnvVar, k8sC, routeC, namespace, exposure)
+	if err != nil {
+		klog.Fatalf("Failed to set up instance exposure: %v", err)
+	}
+	server.Exposer = exposer
+	klog.Infof("Exposing instances via %s", exposer.Name())
+
 	if err := server.GetResourceQuota(ctx); err != nil {
 		klog.Fatalf("Failed to read initial resource quota: %v", err)
 	} else {
@@ -83,9 +165,17 @@ func main() {
 	)
 	r.GET("/health", health)
 	r.GET("/ws/status", server.HandleStatusViaWS)
+	r.GET("/api/payload", server.HandlePayload)
+	r.GET("/api/resolve", server.HandleResolve)
+	r.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+	r.POST("/api/upload", server.HandleUpload)
+	r.GET("/staging/:token/prometheus.tar", server.HandleStaged)
+	r.HEAD("/staging/:token/prometheus.tar", server.HandleStaged)
+	r.Any("/prom/:label/*path", server.HandleProxy)
 
 	go func() {
 		gocron.Every(2).Minutes().Do(server.CleanupOldDeployements, ctx)
+		gocron.Every(1).Minutes().Do(staging.Cleanup)
 		<-gocron.Start()
 	}()
 
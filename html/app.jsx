@@ -7,6 +7,14 @@ class SearchBar extends React.Component {
     this.handleInputChange = this.handleInputChange.bind(this);
     this.handleSnapshotToggle = this.handleSnapshotToggle.bind(this);
     this.handleSubmit = this.handleSubmit.bind(this);
+    this.handleUpload = this.handleUpload.bind(this);
+  }
+
+  handleUpload(event) {
+    if (event.target.files.length > 0) {
+      this.props.onUpload(event.target.files[0]);
+    }
+    event.target.value = "";
   }
 
   handleInputChange(event) {
@@ -29,6 +37,9 @@ class SearchBar extends React.Component {
     );
     if (this.props != null && this.props.appName != null) {
       btn = <DeleteAppButton onDeleteApp={this.props.onDeleteApp} appName={this.props.appName} />;
+      if (this.props.creating) {
+        btn = <CancelAppButton onCancelApp={this.props.onCancelApp} appName={this.props.appName} />;
+      }
     }
     return (
       <ReactBootstrap.Form horizontal>
@@ -38,7 +49,7 @@ class SearchBar extends React.Component {
               <ReactBootstrap.FormControl
                 autoFocus="true"
                 type="text"
-                placeholder="Feed me Prow URLs..."
+                placeholder="Feed me Prow URLs or job name and build ID..."
                 value={this.props.searchInput}
                 onChange={this.handleInputChange}
               />
@@ -46,11 +57,20 @@ class SearchBar extends React.Component {
             <ReactBootstrap.Col xs={3}>
               <ReactBootstrap.Container>{btn}</ReactBootstrap.Container>
               <ReactBootstrap.Container>
-                <ReactBootstrap.Form.Check
-                  type="switch"
-                  id="snapshot-switch"
-                  label="2nd Snapshot"
-                  onChange={this.handleSnapshotToggle}
+                <ReactBootstrap.FormControl as="select" size="sm" id="snapshot-select" onChange={this.handleSnapshotToggle}>
+                  <option value="">prometheus-k8s-0</option>
+                  <option value="altsnap">prometheus-k8s-1</option>
+                  <option value="best">Best coverage</option>
+                </ReactBootstrap.FormControl>
+              </ReactBootstrap.Container>
+              <ReactBootstrap.Container>
+                <input
+                  type="file"
+                  className="form-control-file"
+                  id="upload-archive"
+                  title="Upload prometheus.tar"
+                  accept=".tar,.gz,.tgz,.zst"
+                  onChange={this.handleUpload}
                 />
               </ReactBootstrap.Container>
             </ReactBootstrap.Col>
@@ -71,6 +91,165 @@ class DeleteAppButton extends React.Component {
   }
 }
 
+class CancelAppButton extends React.Component {
+  render() {
+    return (
+      <ReactBootstrap.Button variant="danger" onClick={this.props.onCancelApp}>
+        Cancel {this.props.appName}
+      </ReactBootstrap.Button>
+    );
+  }
+}
+
+class CandidateList extends React.Component {
+  render() {
+    let candidates = JSON.parse(this.props.message);
+    // HyperShift jobs have management and hosted cluster archives which can be loaded together
+    let management = candidates.find((c) => c.cluster === "management");
+    let hosted = management && candidates.find((c) => c.cluster === "hosted" && c.test === management.test);
+    let pairBtn = <span></span>;
+    if (management && hosted) {
+      pairBtn = (
+        <ReactBootstrap.Button
+          size="sm"
+          variant="info"
+          onClick={() => {
+            this.props.onSelectCandidate(management.url || management.replicaURL, hosted.url || hosted.replicaURL);
+          }}
+        >
+          Load management and hosted clusters
+        </ReactBootstrap.Button>
+      );
+    }
+    return (
+      <ReactBootstrap.Alert className="alert-small" variant="warning">
+        <div>Several prometheus archives found, pick one:</div>
+        {candidates.map((c) => (
+          <ReactBootstrap.Row>
+            <ReactBootstrap.Col xs={8}>
+              {c.test}
+              {c.step ? " / " + c.step : ""}
+              {c.cluster ? <ReactBootstrap.Badge variant="secondary">{c.cluster} cluster</ReactBootstrap.Badge> : ""}
+            </ReactBootstrap.Col>
+            <ReactBootstrap.Col xs={2}>{c.size > 0 ? Math.round(c.size / 1048576) + " MiB" : ""}</ReactBootstrap.Col>
+            <ReactBootstrap.Col xs={2}>
+              <ReactBootstrap.Button
+                size="sm"
+                onClick={() => {
+                  this.props.onSelectCandidate(c.url || c.replicaURL);
+                }}
+              >
+                Load
+              </ReactBootstrap.Button>
+            </ReactBootstrap.Col>
+          </ReactBootstrap.Row>
+        ))}
+        {pairBtn}
+      </ReactBootstrap.Alert>
+    );
+  }
+}
+
+class PayloadJobs extends React.Component {
+  constructor(props) {
+    super(props);
+    let payload = JSON.parse(this.props.message);
+    let selected = {};
+    payload.jobs.forEach((job) => {
+      selected[job.url] = job.blocking && job.state === "Failed";
+    });
+    this.state = { payload: payload, selected: selected };
+    this.handleToggle = this.handleToggle.bind(this);
+    this.handleLaunch = this.handleLaunch.bind(this);
+  }
+
+  handleToggle(url) {
+    let selected = Object.assign({}, this.state.selected);
+    selected[url] = !selected[url];
+    this.setState({ selected: selected });
+  }
+
+  handleLaunch() {
+    let urls = Object.keys(this.state.selected).filter((url) => this.state.selected[url]);
+    if (urls.length > 0) {
+      this.props.onLaunchJobs(urls);
+    }
+  }
+
+  render() {
+    let variants = { Succeeded: "success", Failed: "danger" };
+    return (
+      <ReactBootstrap.Alert className="alert-small" variant="light">
+        <div>
+          {this.state.payload.name} ({this.state.payload.phase})
+        </div>
+        {this.state.payload.jobs.map((job) => (
+          <ReactBootstrap.Form.Check
+            type="checkbox"
+            id={job.url}
+            checked={this.state.selected[job.url] || false}
+            onChange={() => this.handleToggle(job.url)}
+            label={
+              <span>
+                <ReactBootstrap.Badge variant={variants[job.state] || "secondary"}>{job.state}</ReactBootstrap.Badge>{" "}
+                {job.blocking ? <b>{job.name}</b> : job.name}
+              </span>
+            }
+          />
+        ))}
+        <ReactBootstrap.Button size="sm" onClick={this.handleLaunch}>
+          Launch selected
+        </ReactBootstrap.Button>
+      </ReactBootstrap.Alert>
+    );
+  }
+}
+
+class JobMetadata extends React.Component {
+  render() {
+    let metadata = JSON.parse(this.props.message);
+    let details = [
+      ["Type", metadata.type],
+      ["State", metadata.state],
+      ["Refs", (metadata.refs || []).join(", ")],
+      ["Cluster profile", metadata.clusterProfile],
+      ["Platform", metadata.platform],
+      [
+        "Payload",
+        metadata.payloadVersion ||
+          (metadata.payloadVersionUnknown &&
+            "unknown (" + metadata.payloadVersionUnknown + ")"),
+      ],
+      ["Cluster versions", (metadata.clusterVersions || []).join(" → ")],
+      [
+        "Job metrics",
+        Object.keys(metadata.jobMetrics || {})
+          .sort()
+          .map((name) => name + " = " + metadata.jobMetrics[name])
+          .join(", "),
+      ],
+    ].filter((detail) => detail[1]);
+    return (
+      <ReactBootstrap.Alert className="alert-small" variant="light">
+        <div>
+          {metadata.url ? (
+            <ReactBootstrap.Alert.Link href={metadata.url} target="_blank">
+              {metadata.job}
+            </ReactBootstrap.Alert.Link>
+          ) : (
+            metadata.job
+          )}
+        </div>
+        {details.map((detail) => (
+          <div key={detail[0]}>
+            <b>{detail[0]}:</b> {detail[1]}
+          </div>
+        ))}
+      </ReactBootstrap.Alert>
+    );
+  }
+}
+
 class Message extends React.Component {
   render() {
     var variants = {
@@ -96,8 +275,10 @@ class Message extends React.Component {
           </ReactBootstrap.Alert>
         );
       case "link":
+        let cluster = this.props.data && this.props.data.cluster;
         return (
           <ReactBootstrap.Alert className="alert-small" variant="primary">
+            {cluster ? <ReactBootstrap.Badge variant="secondary">{cluster} cluster</ReactBootstrap.Badge> : ""}{" "}
             <ReactBootstrap.Alert.Link href={this.props.message} target="_blank">
               {this.props.message}
             </ReactBootstrap.Alert.Link>
@@ -109,6 +290,14 @@ class Message extends React.Component {
             <pre>{this.props.message}</pre>
           </ReactBootstrap.Alert>
         );
+      case "metadata":
+        return <JobMetadata message={this.props.message} />;
+      case "payload":
+        return <PayloadJobs message={this.props.message} onLaunchJobs={this.props.onLaunchJobs} />;
+      case "candidates":
+        return (
+          <CandidateList message={this.props.message} onSelectCandidate={this.props.onSelectCandidate} />
+        );
 
       default:
         return <span></span>;
@@ -159,7 +348,10 @@ class Status extends React.Component {
             <Message
               action={item.action}
               message={item.message}
+              data={item.data}
               onDeleteApp={this.props.onDeleteApp}
+              onSelectCandidate={this.props.onSelectCandidate}
+              onLaunchJobs={this.props.onLaunchJobs}
             />
           ))}
         </div>
@@ -211,10 +403,11 @@ class SearchForm extends React.Component {
     this.state = {
       querySearch: "",
       searchInput: "",
-      snapshotToggle: false,
+      snapshotMode: "",
       messages: [],
       logContent: "",
       appName: null,
+      creating: false,
       apps: storage.getData(),
       ws: null,
       resourceQuota: {
@@ -228,7 +421,11 @@ class SearchForm extends React.Component {
     this.handleSearchSubmit = this.handleSearchSubmit.bind(this);
     this.handleDeleteAppInternal = this.handleDeleteAppInternal.bind(this);
     this.handleDeleteApp = this.handleDeleteApp.bind(this);
+    this.handleUpload = this.handleUpload.bind(this);
+    this.handleCancelCurrentApp = this.handleCancelCurrentApp.bind(this);
     this.handleDeleteCurrentApp = this.handleDeleteCurrentApp.bind(this);
+    this.handleSelectCandidate = this.handleSelectCandidate.bind(this);
+    this.handleLaunchJobs = this.handleLaunchJobs.bind(this);
     this.addMessage = this.addMessage.bind(this);
     this.sendWSMessage = this.sendWSMessage.bind(this);
     this.connect = this.connect.bind(this);
@@ -240,8 +437,8 @@ class SearchForm extends React.Component {
     this.setState({ searchInput: searchInput });
   }
 
-  handleSnapshotToggle(_event) {
-    this.setState({ snapshotToggle: !this.state.snapshotToggle });
+  handleSnapshotToggle(event) {
+    this.setState({ snapshotMode: event.target.value });
   }
 
   handleSearchSubmit(event) {
@@ -251,10 +448,20 @@ class SearchForm extends React.Component {
       return;
     }
 
+    // "<job name> <build ID>" is looked up directly
+    let jobMatch = query.trim().match(/^(\S+)\s+(\d+)$/);
+    if (jobMatch) {
+      this.state.messages = [];
+      this.sendWSMessage(JSON.stringify({ action: "job", data: { job: jobMatch[1], build: jobMatch[2] } }));
+      return;
+    }
+
     try {
       let url = new URL(query);
-      if (this.state.snapshotToggle) {
+      if (this.state.snapshotMode === "altsnap") {
         url.searchParams.append("altsnap", "true");
+      } else if (this.state.snapshotMode) {
+        url.searchParams.append("replicas", this.state.snapshotMode);
       }
 
       this.search(url.toString());
@@ -263,6 +470,26 @@ class SearchForm extends React.Component {
     }
   }
 
+  handleUpload(file) {
+    let form = new FormData();
+    form.append("archive", file);
+    this.setState((_state) => ({
+      messages: [{ action: "status", message: "Uploading " + file.name }],
+    }));
+    fetch("/api/upload", { method: "POST", body: form })
+      .then((response) => response.json())
+      .then((result) => {
+        if (result.error) {
+          this.addMessage({ action: "failure", message: "Failed to upload archive: " + result.error });
+          return;
+        }
+        this.search(result.url);
+      })
+      .catch((error) => {
+        this.addMessage({ action: "failure", message: "Failed to upload archive: " + error });
+      });
+  }
+
   sendWSMessage(message) {
     // add messages to queue if connection is not ready
     if (!this.state.ws || this.state.ws.readyState != WebSocket.OPEN) {
@@ -281,7 +508,9 @@ class SearchForm extends React.Component {
   search(input) {
     try {
       this.state.messages = [];
-      this.sendWSMessage(JSON.stringify({ action: "new", message: input }));
+      // Release payload links list job runs to pick from
+      let action = input.includes("/releasestream/") ? "payload" : "new";
+      this.sendWSMessage(JSON.stringify({ action: action, message: input }));
     } catch (error) {
       console.log(error);
     }
@@ -306,6 +535,33 @@ class SearchForm extends React.Component {
     }));
   }
 
+  handleCancelCurrentApp() {
+    this.sendWSMessage(JSON.stringify({ action: "cancel", message: this.state.appName }));
+    this.setState((_state) => ({ creating: false }));
+  }
+
+  handleSelectCandidate(url, pair) {
+    let data = { url: url };
+    if (pair) {
+      data.pair = pair;
+    }
+    this.sendWSMessage(JSON.stringify({ action: "select", message: this.state.appName, data: data }));
+    // Remove candidates list once the archive is picked
+    let newMessages = this.state.messages.filter(function (message) {
+      return message.action != "candidates";
+    });
+    this.setState((_state) => ({ messages: newMessages }));
+  }
+
+  handleLaunchJobs(urls) {
+    this.sendWSMessage(JSON.stringify({ action: "launch", message: JSON.stringify(urls) }));
+    // Payload job list is no longer needed
+    let newMessages = this.state.messages.filter(function (message) {
+      return message.action != "payload";
+    });
+    this.setState((_state) => ({ messages: newMessages }));
+  }
+
   handleDeleteAppInternal(appName) {
     try {
       this.sendWSMessage(JSON.stringify({ action: "delete", message: appName }));
@@ -328,14 +584,14 @@ class SearchForm extends React.Component {
 
     this.setState((state) => ({ messages: [...state.messages, message] }));
     if (message.action === "app-label") {
-      this.setState((_state) => ({ appName: message.message, logContent: "" }));
+      this.setState((_state) => ({ appName: message.message, creating: true, logContent: "" }));
     }
     if (message.action === "done" || message.action === "error" || message.action === "failure") {
       // Remove message with progress from the list
       let newMessages = this.state.messages.filter(function (message) {
         return message.action != "progress";
       });
-      this.setState((_state) => ({ messages: newMessages, logContent: "" }));
+      this.setState((_state) => ({ messages: newMessages, creating: false, logContent: "" }));
       if (message.data != null) {
         storage.addInstance(message.data.hash, message.data.url);
       }
@@ -441,8 +697,14 @@ class SearchForm extends React.Component {
   render() {
     let messages;
     let searchClass;
-    if (this.state.appName != null) {
-      messages = <Status messages={this.state.messages} />;
+    if (this.state.appName != null || this.state.messages.length > 0) {
+      messages = (
+        <Status
+          messages={this.state.messages}
+          onSelectCandidate={this.handleSelectCandidate}
+          onLaunchJobs={this.handleLaunchJobs}
+        />
+      );
       searchClass = null;
     } else {
       messages = [];
@@ -457,8 +719,11 @@ class SearchForm extends React.Component {
           onSearchInput={this.handleSearchInput}
           onSearchSubmit={this.handleSearchSubmit}
           onSnapshotToggle={this.handleSnapshotToggle}
+          onUpload={this.handleUpload}
           onDeleteApp={this.handleDeleteCurrentApp}
+          onCancelApp={this.handleCancelCurrentApp}
           appName={this.state.appName}
+          creating={this.state.creating}
         />
         <ReactBootstrap.Row>
           <ReactBootstrap.Col xs={4} />
@@ -0,0 +1,242 @@
+package promecieus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	backfillDir = "backfill"
+	// backfillStep is the interval between generated samples, like a scrape interval
+	backfillStep = 30 * time.Second
+	// backfillSourceLimit is the maximum size of a single artifact converted into series
+	backfillSourceLimit = 256 * 1024 * 1024
+)
+
+// BackfillSource is a job artifact converted into synthetic series
+type BackfillSource struct {
+	Kind string `json:"kind"`
+	URL  string `json:"url"`
+	// Test and Step the artifact was found in
+	Test string `json:"test,omitempty"`
+	Step string `json:"step,omitempty"`
+}
+
+// cluster returns which HyperShift cluster the source describes.
+// Management cluster is gathered by dedicated steps, all other steps run against the hosted cluster
+func (b BackfillSource) cluster() string {
+	if isManagementClusterStep(b.Step) {
+		return clusterManagement
+	}
+	return clusterHosted
+}
+
+// testBackfill returns sources of the candidate test and cluster
+func testBackfill(sources []BackfillSource, c MetricsCandidate) []BackfillSource {
+	var scoped []BackfillSource
+	for _, source := range sources {
+		if source.Test != c.Test || (c.Cluster != "" && source.cluster() != c.Cluster) {
+			continue
+		}
+		scoped = append(scoped, source)
+	}
+	return scoped
+}
+
+// backfillConverters turn artifacts into series, keyed by source kind
+var backfillConverters = map[string]func(io.Reader, *openMetricsWriter) error{}
+
+// openMetricsWriter collects samples and writes them in OpenMetrics text format,
+// which promtool can turn into TSDB blocks
+type openMetricsWriter struct {
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	metricType string
+	help       string
+	series     map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels  string
+	samples map[int64]float64
+}
+
+func newOpenMetricsWriter() *openMetricsWriter {
+	return &openMetricsWriter{families: map[string]*metricFamily{}}
+}
+
+// family declares a metric family, it has to be called before adding samples
+func (w *openMetricsWriter) family(name, metricType, help string) {
+	if _, ok := w.families[name]; !ok {
+		w.families[name] = &metricFamily{metricType: metricType, help: help, series: map[string]*metricSeries{}}
+	}
+}
+
+// add records a sample, sample at the same timestamp is overwritten
+func (w *openMetricsWriter) add(name string, labels map[string]string, t time.Time, value float64) {
+	f := w.families[name]
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labels: key, samples: map[int64]float64{}}
+		f.series[key] = s
+	}
+	s.samples[t.UnixMilli()] = value
+}
+
+// empty is true if no samples were added
+func (w *openMetricsWriter) empty() bool {
+	for _, f := range w.families {
+		if len(f.series) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTo writes families with their series sorted, samples of a series are in time order
+func (w *openMetricsWriter) WriteTo(out io.Writer) (int64, error) {
+	var b bytes.Buffer
+	names := make([]string, 0, len(w.families))
+	for name := range w.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := w.families[name]
+		if len(f.series) == 0 {
+			continue
+		}
+		// OpenMetrics counter families are named without _total suffix of their samples
+		familyName := name
+		if f.metricType == "counter" {
+			familyName = strings.TrimSuffix(name, "_total")
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", familyName, f.help, familyName, f.metricType)
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			timestamps := make([]int64, 0, len(s.samples))
+			for t := range s.samples {
+				timestamps = append(timestamps, t)
+			}
+			sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+			for _, t := range timestamps {
+				fmt.Fprintf(&b, "%s%s %g %d.%03d\n", name, s.labels, s.samples[t], t/1000, t%1000)
+			}
+		}
+	}
+	b.WriteString("# EOF\n")
+	return b.WriteTo(out)
+}
+
+// formatLabels returns sorted label set in exposition format, empty values are dropped
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name, value := range labels {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(labels[name])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+// stageBackfill converts backfill sources into OpenMetrics files and stages them for the init container.
+// Synthetic series are optional, so failures are reported and skipped
+func (s *ServerSettings) stageBackfill(ctx context.Context, conn *websocket.Conn, prowInfo *ProwInfo) {
+	if s.Staging == nil {
+		return
+	}
+	for _, source := range prowInfo.Backfill {
+		convert, ok := backfillConverters[source.Kind]
+		if !ok {
+			klog.Warningf("No converter for %s backfill source %s", source.Kind, source.URL)
+			continue
+		}
+		sendWSMessage(conn, "status", fmt.Sprintf("Converting %s at %s into series", source.Kind, source.URL))
+		w := newOpenMetricsWriter()
+		if err := s.fetchBackfillSource(ctx, source.URL, w, convert); err != nil {
+			sendWSMessage(conn, "status", fmt.Sprintf("Skipping %s: %v", source.Kind, err))
+			continue
+		}
+		if w.empty() {
+			continue
+		}
+		var b bytes.Buffer
+		if _, err := w.WriteTo(&b); err != nil {
+			sendWSMessage(conn, "status", fmt.Sprintf("Skipping %s: %v", source.Kind, err))
+			continue
+		}
+		token, err := s.Staging.Store(&b)
+		if err != nil {
+			sendWSMessage(conn, "status", fmt.Sprintf("Skipping %s: %v", source.Kind, err))
+			continue
+		}
+		prowInfo.BackfillURLs = append(prowInfo.BackfillURLs, s.Staging.URL(token))
+	}
+}
+
+func (s *ServerSettings) fetchBackfillSource(ctx context.Context, sourceURL string, w *openMetricsWriter, convert func(io.Reader, *openMetricsWriter) error) error {
+	resp, err := s.Fetcher.Get(ctx, sourceURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch %s: returned %s", sourceURL, resp.Status)
+	}
+	return convert(io.LimitReader(resp.Body, backfillSourceLimit), w)
+}
+
+// backfillFetchCommands download staged OpenMetrics files next to the TSDB blocks
+func backfillFetchCommands(backfillURLs []string) ([]string, []corev1.EnvVar) {
+	if len(backfillURLs) == 0 {
+		return nil, nil
+	}
+	commands := []string{fmt.Sprintf("mkdir -p %s", backfillDir)}
+	env := []corev1.EnvVar{}
+	for i, u := range backfillURLs {
+		envName := fmt.Sprintf("BACKFILL_%d", i+1)
+		env = append(env, corev1.EnvVar{
+			Name:  envName,
+			Value: u,
+		})
+		// Synthetic series are optional, failed download should not block the instance
+		commands = append(commands, fmt.Sprintf("{ curl -sLf -o %[1]s/%[2]d.om ${%[3]s} || rm -f %[1]s/%[2]d.om; }", backfillDir, i+1, envName))
+	}
+	return commands, env
+}
+
+// backfillScript creates TSDB blocks from downloaded OpenMetrics files.
+// It runs in prometheus image, which ships promtool
+func backfillScript() string {
+	return fmt.Sprintf(`for f in %[1]s/*.om; do [ -f "$f" ] || continue; promtool tsdb create-blocks-from openmetrics "$f" . || echo "failed to backfill $f"; done; rm -rf %[1]s`, backfillDir)
+}
@@ -0,0 +1,117 @@
+package promecieus
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOpenMetricsWriter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := newOpenMetricsWriter()
+	if !w.empty() {
+		t.Fatal("expected new writer to be empty")
+	}
+	w.family("b_events_total", "counter", "Events")
+	w.family("a_gauge", "gauge", "Gauge")
+	w.family("c_unused", "gauge", "Unused")
+	w.add("b_events_total", map[string]string{"reason": "BackOff"}, start.Add(time.Minute), 2)
+	w.add("b_events_total", map[string]string{"reason": "BackOff"}, start, 1)
+	w.add("a_gauge", map[string]string{"z": "1", "a": "say \"hi\"\n\\", "empty": ""}, start.Add(1500*time.Millisecond), 0.5)
+	// Sample at the same timestamp is overwritten
+	w.add("a_gauge", map[string]string{}, start, 3)
+	w.add("a_gauge", nil, start, 4)
+	if w.empty() {
+		t.Fatal("expected writer with samples not to be empty")
+	}
+
+	var b bytes.Buffer
+	if _, err := w.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP a_gauge Gauge
+# TYPE a_gauge gauge
+a_gauge 4 1704067200.000
+a_gauge{a="say \"hi\"\n\\",z="1"} 0.5 1704067201.500
+# HELP b_events Events
+# TYPE b_events counter
+b_events_total{reason="BackOff"} 1 1704067200.000
+b_events_total{reason="BackOff"} 2 1704067260.000
+# EOF
+`
+	if b.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestTestBackfill(t *testing.T) {
+	sources := []BackfillSource{
+		{Kind: intervalsKind, URL: "e2e-intervals", Test: "e2e-hypershift", Step: "hypershift-e2e"},
+		{Kind: eventsKind, URL: "hosted-events", Test: "e2e-hypershift", Step: extraPath},
+		{Kind: eventsKind, URL: "management-events", Test: "e2e-hypershift", Step: hypershiftExtraPath},
+		{Kind: eventsKind, URL: "upgrade-events", Test: "e2e-upgrade", Step: extraPath},
+	}
+	for _, tc := range []struct {
+		name      string
+		candidate MetricsCandidate
+		expected  []string
+	}{
+		{
+			name:      "regular job",
+			candidate: MetricsCandidate{Test: "e2e-upgrade", Step: extraPath},
+			expected:  []string{"upgrade-events"},
+		},
+		{
+			name:      "hosted cluster",
+			candidate: MetricsCandidate{Test: "e2e-hypershift", Step: extraPath, Cluster: clusterHosted},
+			expected:  []string{"e2e-intervals", "hosted-events"},
+		},
+		{
+			name:      "management cluster",
+			candidate: MetricsCandidate{Test: "e2e-hypershift", Step: hypershiftExtraPath, Cluster: clusterManagement},
+			expected:  []string{"management-events"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			urls := []string{}
+			for _, source := range testBackfill(sources, tc.candidate) {
+				urls = append(urls, source.URL)
+			}
+			if !reflect.DeepEqual(urls, tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, urls)
+			}
+		})
+	}
+}
+
+func TestSelectedPairGetsOwnBackfill(t *testing.T) {
+	prowInfo := ProwInfo{artifacts: &jobArtifacts{backfill: []BackfillSource{
+		{Kind: intervalsKind, URL: "hosted", Test: "e2e", Step: "hypershift-e2e"},
+		{Kind: eventsKind, URL: "management", Test: "e2e", Step: hypershiftExtraPath},
+	}}}
+	hosted := MetricsCandidate{Test: "e2e", Step: extraPath, URL: "hosted.tar", Cluster: clusterHosted}
+	management := MetricsCandidate{Test: "e2e", Step: hypershiftExtraPath, URL: "management.tar", Cluster: clusterManagement}
+	prowInfo.Candidates = []MetricsCandidate{hosted, management}
+
+	conn, messages := wsPair(t)
+	s := &ServerSettings{Selections: &PendingSelections{}}
+	u, _ := url.Parse("https://prow.ci.openshift.org/view/gs/bucket/logs/job/1")
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.selectCandidate(context.Background(), conn, "abcde", u, &prowInfo)
+	}()
+	nextMessage(t, messages, "candidates")
+	s.Selections.Pick("abcde", candidateSelection{url: hosted.URL, pair: management.URL})
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if len(prowInfo.Backfill) != 1 || prowInfo.Backfill[0].URL != "hosted" {
+		t.Errorf("expected hosted instance to get hosted cluster sources, got %+v", prowInfo.Backfill)
+	}
+	if prowInfo.Pair == nil || len(prowInfo.Pair.Backfill) != 1 || prowInfo.Pair.Backfill[0].URL != "management" {
+		t.Errorf("expected pair to get management cluster sources, got %+v", prowInfo.Pair)
+	}
+}
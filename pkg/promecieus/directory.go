@@ -0,0 +1,122 @@
+package promecieus
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// directorySearchDepth limits how deep directories are searched for prometheus archives
+const directorySearchDepth = 5
+
+// artifactStore lists folders and builds download links for the objects found
+type artifactStore interface {
+	artifactLister
+	ObjectURL(bucket, name string) string
+}
+
+// directoryResolver looks for prometheus archives in a folder tree of a generic artifact store
+type directoryResolver struct {
+	name  string
+	store artifactStore
+	// locate returns bucket and object prefix for the URL, ok is false if the URL is not handled
+	locate func(u *url.URL) (bucket, prefix string, ok bool)
+}
+
+func (d *directoryResolver) Name() string {
+	return d.name
+}
+
+func (d *directoryResolver) Match(u *url.URL) bool {
+	_, _, ok := d.locate(u)
+	return ok
+}
+
+func (d *directoryResolver) Resolve(ctx context.Context, u *url.URL) (ProwInfo, error) {
+	bucket, prefix, ok := d.locate(u)
+	if !ok {
+		return ProwInfo{}, fmt.Errorf("%s is not supported by %s resolver", u, d.name)
+	}
+	// Time range is read from the blocks later
+	prowInfo := ProwInfo{Started: time.Now(), Finished: time.Now()}
+
+	if isArchiveName(prefix) {
+		prowInfo.MetricsURL = d.store.ObjectURL(bucket, prefix)
+		if sibling := siblingReplicaURL(prefix); sibling != "" {
+			prowInfo.ReplicaURL = d.store.ObjectURL(bucket, sibling)
+		}
+		return prowInfo, nil
+	}
+
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	found := map[string]*replicaArchives{}
+	if err := d.findArchives(ctx, bucket, prefix, directorySearchDepth, found); err != nil {
+		return prowInfo, err
+	}
+	if len(found) == 0 {
+		return prowInfo, fmt.Errorf("no prometheus archive found in %s", u)
+	}
+
+	folders := make([]string, 0, len(found))
+	for folder := range found {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+	for _, folder := range folders {
+		archives := found[folder]
+		// Archives are usually kept in metrics folder, so name candidates after the parent folder
+		test := strings.TrimSuffix(strings.TrimPrefix(folder, prefix), "/")
+		if path.Base(test) == path.Dir(promTarPath) {
+			test = path.Dir(test)
+		}
+		c := MetricsCandidate{Test: test}
+		if archives.primary != nil {
+			c.URL = d.store.ObjectURL(bucket, archives.primary.Name)
+			c.Size = archives.primary.Size
+		}
+		if archives.replica != nil {
+			c.ReplicaURL = d.store.ObjectURL(bucket, archives.replica.Name)
+			c.ReplicaSize = archives.replica.Size
+		}
+		prowInfo.Candidates = append(prowInfo.Candidates, c)
+	}
+	prowInfo.useCandidate(prowInfo.Candidates[0])
+	return prowInfo, nil
+}
+
+// findArchives collects prometheus archives of the folder and its subfolders, keyed by folder
+func (d *directoryResolver) findArchives(ctx context.Context, bucket, prefix string, depth int, found map[string]*replicaArchives) error {
+	listing, err := d.store.List(ctx, bucket, prefix)
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %v", prefix, err)
+	}
+	for _, obj := range listing.Objects {
+		switch path.Base(obj.Name) {
+		case path.Base(promTarPath):
+			if found[prefix] == nil {
+				found[prefix] = &replicaArchives{}
+			}
+			found[prefix].primary = &obj
+		case path.Base(prom2ndTarPath):
+			if found[prefix] == nil {
+				found[prefix] = &replicaArchives{}
+			}
+			found[prefix].replica = &obj
+		}
+	}
+	if depth == 0 {
+		return nil
+	}
+	for _, subfolder := range listing.Prefixes {
+		if err := d.findArchives(ctx, bucket, subfolder, depth-1, found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package promecieus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	eventsKind   = "events"
+	eventsFile   = "events.json"
+	eventsMetric = "promecieus_events_total"
+)
+
+func init() {
+	backfillConverters[eventsKind] = convertEvents
+}
+
+// clusterEvents is events.json dumped by gather-extra
+type clusterEvents struct {
+	Items []clusterEvent `json:"items"`
+}
+
+// clusterEvent has fields of both core/v1 and events.k8s.io events
+type clusterEvent struct {
+	Metadata struct {
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	InvolvedObject struct {
+		Kind string `json:"kind"`
+	} `json:"involvedObject"`
+	Reason         string    `json:"reason"`
+	Type           string    `json:"type"`
+	Count          int       `json:"count"`
+	FirstTimestamp time.Time `json:"firstTimestamp"`
+	LastTimestamp  time.Time `json:"lastTimestamp"`
+	EventTime      time.Time `json:"eventTime"`
+	Series         *struct {
+		Count            int       `json:"count"`
+		LastObservedTime time.Time `json:"lastObservedTime"`
+	} `json:"series"`
+}
+
+// occurrences returns times the event was seen. Repeated events only keep the first and the last time,
+// so repetitions are spread evenly in between
+func (e *clusterEvent) occurrences() []time.Time {
+	first, last, count := e.FirstTimestamp, e.LastTimestamp, e.Count
+	if first.IsZero() {
+		first = e.EventTime
+	}
+	if e.Series != nil {
+		last, count = e.Series.LastObservedTime, e.Series.Count
+	}
+	if first.IsZero() {
+		return nil
+	}
+	if count <= 1 || !last.After(first) {
+		return []time.Time{first}
+	}
+	times := make([]time.Time, 0, count)
+	interval := last.Sub(first) / time.Duration(count-1)
+	for i := 0; i < count; i++ {
+		times = append(times, first.Add(time.Duration(i)*interval))
+	}
+	return times
+}
+
+// convertEvents counts cluster events by namespace, involved object kind, reason and type.
+// Counters are sampled every backfillStep, so that rate() and increase() work as for scraped metrics
+func convertEvents(r io.Reader, w *openMetricsWriter) error {
+	var events clusterEvents
+	if err := json.NewDecoder(r).Decode(&events); err != nil {
+		return fmt.Errorf("failed to unmarshal events: %v", err)
+	}
+	w.family(eventsMetric, "counter", "Cluster events from gather-extra by namespace, involved object kind, reason and type")
+
+	occurrences := map[string][]time.Time{}
+	labelSets := map[string]map[string]string{}
+	var end time.Time
+	for _, event := range events.Items {
+		times := event.occurrences()
+		if len(times) == 0 {
+			continue
+		}
+		labels := map[string]string{
+			"namespace": event.Metadata.Namespace,
+			"kind":      event.InvolvedObject.Kind,
+			"reason":    event.Reason,
+			"type":      event.Type,
+		}
+		key := formatLabels(labels)
+		labelSets[key] = labels
+		occurrences[key] = append(occurrences[key], times...)
+		if last := times[len(times)-1]; last.After(end) {
+			end = last
+		}
+	}
+
+	for key, times := range occurrences {
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+		// Counter starts at zero right before the first event, so that the first increase is visible
+		start := times[0].Truncate(backfillStep)
+		w.add(eventsMetric, labelSets[key], start.Add(-backfillStep), 0)
+		seen := 0
+		for t := start; !t.After(end.Add(backfillStep)); t = t.Add(backfillStep) {
+			for seen < len(times) && !times[seen].After(t) {
+				seen++
+			}
+			w.add(eventsMetric, labelSets[key], t, float64(seen))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package promecieus
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConvertEvents(t *testing.T) {
+	events := `{"items": [
+		{"metadata": {"namespace": "openshift-etcd"}, "involvedObject": {"kind": "Pod"}, "reason": "BackOff", "type": "Warning",
+		 "count": 3, "firstTimestamp": "2024-01-01T00:00:10Z", "lastTimestamp": "2024-01-01T00:01:10Z"},
+		{"metadata": {}, "involvedObject": {"kind": "Node"}, "reason": "Say \"hi\"\n", "type": "Normal",
+		 "firstTimestamp": null, "eventTime": "2024-01-01T00:01:05.000000Z",
+		 "series": {"count": 2, "lastObservedTime": "2024-01-01T00:01:35.000000Z"}},
+		{"metadata": {"namespace": "default"}, "involvedObject": {"kind": "Pod"}, "reason": "NoTimestamps", "type": "Normal"}
+	]}`
+	w := newOpenMetricsWriter()
+	if err := convertEvents(strings.NewReader(events), w); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if _, err := w.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	// Counters start at zero a step before the first event and are sampled till a step after the last one
+	expected := `# HELP promecieus_events Cluster events from gather-extra by namespace, involved object kind, reason and type
+# TYPE promecieus_events counter
+promecieus_events_total{kind="Node",reason="Say \"hi\"\n",type="Normal"} 0 1704067230.000
+promecieus_events_total{kind="Node",reason="Say \"hi\"\n",type="Normal"} 0 1704067260.000
+promecieus_events_total{kind="Node",reason="Say \"hi\"\n",type="Normal"} 1 1704067290.000
+promecieus_events_total{kind="Node",reason="Say \"hi\"\n",type="Normal"} 2 1704067320.000
+promecieus_events_total{kind="Pod",namespace="openshift-etcd",reason="BackOff",type="Warning"} 0 1704067170.000
+promecieus_events_total{kind="Pod",namespace="openshift-etcd",reason="BackOff",type="Warning"} 0 1704067200.000
+promecieus_events_total{kind="Pod",namespace="openshift-etcd",reason="BackOff",type="Warning"} 1 1704067230.000
+promecieus_events_total{kind="Pod",namespace="openshift-etcd",reason="BackOff",type="Warning"} 2 1704067260.000
+promecieus_events_total{kind="Pod",namespace="openshift-etcd",reason="BackOff",type="Warning"} 3 1704067290.000
+promecieus_events_total{kind="Pod",namespace="openshift-etcd",reason="BackOff",type="Warning"} 3 1704067320.000
+# EOF
+`
+	if b.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestConvertEventsInvalid(t *testing.T) {
+	if err := convertEvents(strings.NewReader(`{"items": {}}`), newOpenMetricsWriter()); err == nil {
+		t.Error("expected malformed events to fail")
+	}
+}
+
+func TestEventOccurrences(t *testing.T) {
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name     string
+		event    clusterEvent
+		expected []time.Time
+	}{
+		{
+			name:     "single event",
+			event:    clusterEvent{Count: 1, FirstTimestamp: first, LastTimestamp: first},
+			expected: []time.Time{first},
+		},
+		{
+			name:     "repeated event without last timestamp",
+			event:    clusterEvent{Count: 5, FirstTimestamp: first},
+			expected: []time.Time{first},
+		},
+		{
+			name:     "repeated event",
+			event:    clusterEvent{Count: 3, FirstTimestamp: first, LastTimestamp: first.Add(time.Minute)},
+			expected: []time.Time{first, first.Add(30 * time.Second), first.Add(time.Minute)},
+		},
+		{
+			name:     "no timestamps",
+			event:    clusterEvent{Count: 3},
+			expected: nil,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if times := tc.event.occurrences(); !reflect.DeepEqual(times, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, times)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package promecieus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+
+	routeApi "github.com/openshift/api/route/v1"
+	routeClient "github.com/openshift/client-go/route/clientset/versioned/typed/route/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+const (
+	exposureRoute   = "route"
+	exposureIngress = "ingress"
+	exposureGateway = "gateway"
+	exposureProxy   = "proxy"
+
+	ingressTemplate   = "ingress.yaml"
+	httpRouteTemplate = "httproute.yaml"
+)
+
+var httpRouteResource = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "httproutes"}
+
+// exposureObjects return empty objects exposure templates are decoded into, keyed by template
+var exposureObjects = map[string]func() metav1.Object{
+	routeTemplate:     func() metav1.Object { return &routeApi.Route{} },
+	ingressTemplate:   func() metav1.Object { return &networkingv1.Ingress{} },
+	httpRouteTemplate: func() metav1.Object { return &unstructured.Unstructured{} },
+}
+
+// ExposureSettings configures how instances are reachable from outside of the cluster
+type ExposureSettings struct {
+	// Kind is route, ingress, gateway or proxy
+	Kind string
+	// Host is a template of instance host name, i.e. {{ .AppLabel }}.prom.example.com.
+	// Routes get a generated host when it's empty, other backends require it
+	Host string
+	// Scheme of instance links for ingress and gateway backends, https by default
+	Scheme string
+	// TLSTermination of routes, plain HTTP routes are created when it's empty
+	TLSTermination string
+	// IngressClass is the class of created ingresses, cluster default is used when it's empty
+	IngressClass string
+	// TLSSecret enables TLS for ingresses using certificate from this secret
+	TLSSecret string
+	// Gateway, GatewayNamespace and GatewaySection are parent of created HTTPRoutes
+	Gateway          string
+	GatewayNamespace string
+	GatewaySection   string
+	// PublicURL is promecieus URL instance links are built from by the proxy backend
+	PublicURL string
+}
+
+// Exposer creates and removes objects which make instance service reachable
+type Exposer interface {
+	Name() string
+	// Template is the name of manifest template rendering the exposing object,
+	// empty if the backend doesn't create any
+	Template() string
+	// Configure sets exposure settings, host and route prefix of the instance in manifest params
+	Configure(params *manifestParams) error
+	// Create creates the rendered object and returns the instance URL
+	Create(ctx context.Context, appLabel string, obj metav1.Object) (string, error)
+	// ProbeURL returns URL promecieus checks instance readiness at
+	ProbeURL(appLabel, instanceURL string) string
+	// Remove deletes objects of the instance and returns the list of removed objects
+	Remove(ctx context.Context, appLabel string) ([]string, error)
+}
+
+// NewExposer returns exposure backend selected by settings
+func NewExposer(kubeconfigPath string, k8sC *k8s.Clientset, routeC *routeClient.RouteV1Client, namespace string, settings ExposureSettings) (Exposer, error) {
+	if settings.Scheme == "" {
+		settings.Scheme = "https"
+	}
+	hosts, err := template.New("host").Option("missingkey=error").Parse(settings.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host template %q: %v", settings.Host, err)
+	}
+	base := exposureBase{hosts: hosts, settings: settings}
+	if err := base.Configure(&manifestParams{AppLabel: sampleParams.AppLabel}); err != nil {
+		return nil, err
+	}
+	if settings.Host == "" && (settings.Kind == exposureIngress || settings.Kind == exposureGateway) {
+		return nil, fmt.Errorf("host template is required for %s exposure", settings.Kind)
+	}
+
+	switch settings.Kind {
+	case exposureRoute, "":
+		return &routeExposer{base, routeC, namespace}, nil
+	case exposureIngress:
+		return &ingressExposer{base, k8sC, namespace}, nil
+	case exposureProxy:
+		if settings.PublicURL == "" {
+			return nil, fmt.Errorf("public URL is required for %s exposure", settings.Kind)
+		}
+		return newProxyExposer(base, namespace), nil
+	case exposureGateway:
+		if settings.Gateway == "" {
+			return nil, fmt.Errorf("gateway name is required for %s exposure", settings.Kind)
+		}
+		config, err := buildConfig(kubeconfigPath)
+		if err != nil {
+			return nil, err
+		}
+		client, err := dynamic.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return &gatewayExposer{base, client, namespace}, nil
+	default:
+		return nil, fmt.Errorf("unknown exposure %q, expected %s, %s, %s or %s",
+			settings.Kind, exposureRoute, exposureIngress, exposureGateway, exposureProxy)
+	}
+}
+
+// exposureBase renders instance host names and keeps settings shared by all backends
+type exposureBase struct {
+	hosts    *template.Template
+	settings ExposureSettings
+}
+
+func (e *exposureBase) Configure(params *manifestParams) error {
+	var b bytes.Buffer
+	if err := e.hosts.Execute(&b, params); err != nil {
+		return fmt.Errorf("failed to render host template: %v", err)
+	}
+	params.Host = b.String()
+	params.Exposure = e.settings
+	return nil
+}
+
+// ProbeURL checks readiness through the exposing object, so that links work once instance is reported ready
+func (e *exposureBase) ProbeURL(appLabel, instanceURL string) string {
+	return instanceURL
+}
+
+// routeExposer creates OpenShift routes
+type routeExposer struct {
+	exposureBase
+	client    *routeClient.RouteV1Client
+	namespace string
+}
+
+func (r *routeExposer) Name() string {
+	return exposureRoute
+}
+
+func (r *routeExposer) Template() string {
+	return routeTemplate
+}
+
+func (r *routeExposer) Create(ctx context.Context, appLabel string, obj metav1.Object) (string, error) {
+	route, err := r.client.Routes(r.namespace).Create(ctx, obj.(*routeApi.Route), metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to create route: %v", err)
+	}
+	if route.Spec.TLS == nil {
+		return fmt.Sprintf("http://%s", route.Spec.Host), nil
+	}
+	return fmt.Sprintf("https://%s", route.Spec.Host), nil
+}
+
+func (r *routeExposer) Remove(ctx context.Context, appLabel string) ([]string, error) {
+	removed := []string{}
+	listOpts := metav1.ListOptions{LabelSelector: fmt.Sprintf("app=%s", appLabel)}
+	routeList, err := r.client.Routes(r.namespace).List(ctx, listOpts)
+	if err != nil || routeList.Items == nil {
+		return removed, fmt.Errorf("failed to find routes: %v", err)
+	}
+	for _, route := range routeList.Items {
+		err := r.client.Routes(r.namespace).Delete(ctx, route.Name, metav1.DeleteOptions{})
+		if err != nil {
+			return removed, fmt.Errorf("error removing route %s: %v", route.Name, err)
+		}
+		removed = append(removed, fmt.Sprintf("Removed route %s", route.Name))
+	}
+	return removed, nil
+}
+
+// ingressExposer creates networking.k8s.io ingresses
+type ingressExposer struct {
+	exposureBase
+	client    *k8s.Clientset
+	namespace string
+}
+
+func (i *ingressExposer) Name() string {
+	return exposureIngress
+}
+
+func (i *ingressExposer) Template() string {
+	return ingressTemplate
+}
+
+func (i *ingressExposer) Create(ctx context.Context, appLabel string, obj metav1.Object) (string, error) {
+	ingress, err := i.client.NetworkingV1().Ingresses(i.namespace).Create(ctx, obj.(*networkingv1.Ingress), metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to create ingress: %v", err)
+	}
+	if len(ingress.Spec.Rules) == 0 || ingress.Spec.Rules[0].Host == "" {
+		return "", fmt.Errorf("ingress %s has no host", ingress.Name)
+	}
+	return fmt.Sprintf("%s://%s", i.settings.Scheme, ingress.Spec.Rules[0].Host), nil
+}
+
+func (i *ingressExposer) Remove(ctx context.Context, appLabel string) ([]string, error) {
+	removed := []string{}
+	listOpts := metav1.ListOptions{LabelSelector: fmt.Sprintf("app=%s", appLabel)}
+	ingressList, err := i.client.NetworkingV1().Ingresses(i.namespace).List(ctx, listOpts)
+	if err != nil || ingressList.Items == nil {
+		return removed, fmt.Errorf("failed to find ingresses: %v", err)
+	}
+	for _, ingress := range ingressList.Items {
+		err := i.client.NetworkingV1().Ingresses(i.namespace).Delete(ctx, ingress.Name, metav1.DeleteOptions{})
+		if err != nil {
+			return removed, fmt.Errorf("error removing ingress %s: %v", ingress.Name, err)
+		}
+		removed = append(removed, fmt.Sprintf("Removed ingress %s", ingress.Name))
+	}
+	return removed, nil
+}
+
+// gatewayExposer creates Gateway API HTTPRoutes. Gateway API types are not vendored,
+// so routes are handled as unstructured objects
+type gatewayExposer struct {
+	exposureBase
+	client    dynamic.Interface
+	namespace string
+}
+
+func (g *gatewayExposer) Name() string {
+	return exposureGateway
+}
+
+func (g *gatewayExposer) Template() string {
+	return httpRouteTemplate
+}
+
+func (g *gatewayExposer) Create(ctx context.Context, appLabel string, obj metav1.Object) (string, error) {
+	route, err := g.client.Resource(httpRouteResource).Namespace(g.namespace).Create(ctx, obj.(*unstructured.Unstructured), metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to create HTTPRoute: %v", err)
+	}
+	hostnames, _, err := unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+	if err != nil || len(hostnames) == 0 {
+		return "", fmt.Errorf("HTTPRoute %s has no hostnames", route.GetName())
+	}
+	return fmt.Sprintf("%s://%s", g.settings.Scheme, hostnames[0]), nil
+}
+
+func (g *gatewayExposer) Remove(ctx context.Context, appLabel string) ([]string, error) {
+	removed := []string{}
+	listOpts := metav1.ListOptions{LabelSelector: fmt.Sprintf("app=%s", appLabel)}
+	routeList, err := g.client.Resource(httpRouteResource).Namespace(g.namespace).List(ctx, listOpts)
+	if err != nil {
+		return removed, fmt.Errorf("failed to find HTTPRoutes: %v", err)
+	}
+	for _, route := range routeList.Items {
+		err := g.client.Resource(httpRouteResource).Namespace(g.namespace).Delete(ctx, route.GetName(), metav1.DeleteOptions{})
+		if err != nil {
+			return removed, fmt.Errorf("error removing HTTPRoute %s: %v", route.GetName(), err)
+		}
+		removed = append(removed, fmt.Sprintf("Removed HTTPRoute %s", route.GetName()))
+	}
+	return removed, nil
+}
@@ -0,0 +1,174 @@
+package promecieus
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// fetchMetrics are artifact fetch counters, exposed at /debug/vars
+var fetchMetrics = expvar.NewMap("promecieus_fetch")
+
+// FetcherSettings configures HTTP requests made while discovering artifacts
+type FetcherSettings struct {
+	// Timeout is the time to wait for response headers
+	Timeout time.Duration
+	// Retries is the number of retries of idempotent requests failed with network or 5xx errors
+	Retries int
+	// Backoff is the delay before the first retry, doubled on every next retry
+	Backoff time.Duration
+	// HostConcurrency limits the number of simultaneous requests to a single host
+	HostConcurrency int
+}
+
+// DefaultFetcherSettings returns settings used when no overrides are set
+func DefaultFetcherSettings() FetcherSettings {
+	return FetcherSettings{
+		Timeout:         10 * time.Second,
+		Retries:         3,
+		Backoff:         500 * time.Millisecond,
+		HostConcurrency: 8,
+	}
+}
+
+// Fetcher is an HTTP client shared by all artifact discovery code
+type Fetcher struct {
+	settings FetcherSettings
+	client   *http.Client
+
+	hostsLock sync.Mutex
+	hosts     map[string]chan struct{}
+}
+
+// NewFetcher creates a fetcher with the settings
+func NewFetcher(settings FetcherSettings) *Fetcher {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: settings.Timeout}).DialContext
+	transport.ResponseHeaderTimeout = settings.Timeout
+	return &Fetcher{
+		settings: settings,
+		client:   &http.Client{Transport: transport},
+		hosts:    make(map[string]chan struct{}),
+	}
+}
+
+// hostSlots returns a semaphore limiting concurrent requests to the host
+func (f *Fetcher) hostSlots(host string) chan struct{} {
+	f.hostsLock.Lock()
+	defer f.hostsLock.Unlock()
+	slots, ok := f.hosts[host]
+	if !ok {
+		slots = make(chan struct{}, max(f.settings.HostConcurrency, 1))
+		f.hosts[host] = slots
+	}
+	return slots
+}
+
+// releasingBody frees the host slot when response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// isRetryable checks if request may succeed when repeated
+func isRetryable(resp *http.Response) bool {
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// Do sends a request, waiting for a free host slot first. GET and HEAD requests are retried
+// with exponential backoff. Returned response body must be closed to free the slot
+func (f *Fetcher) Do(ctx context.Context, method, rawURL string, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", rawURL, err)
+	}
+	slots := f.hostSlots(u.Host)
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release := func() { <-slots }
+
+	retries := 0
+	if method == http.MethodGet || method == http.MethodHead {
+		retries = f.settings.Retries
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+		if err != nil {
+			release()
+			return nil, fmt.Errorf("failed to construct %s request to %s: %v", method, rawURL, err)
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+
+		fetchMetrics.Add("requests", 1)
+		fetchMetrics.Add("in_flight", 1)
+		started := time.Now()
+		resp, err := f.client.Do(req)
+		fetchMetrics.Add("in_flight", -1)
+		fetchMetrics.Add("duration_ms", time.Since(started).Milliseconds())
+		if err == nil {
+			fetchMetrics.Add("status_"+strconv.Itoa(resp.StatusCode), 1)
+		} else {
+			fetchMetrics.Add("errors", 1)
+		}
+
+		if (err == nil && !isRetryable(resp)) || attempt >= retries || ctx.Err() != nil {
+			if err != nil {
+				release()
+				return nil, fmt.Errorf("failed to fetch %s: %v", rawURL, err)
+			}
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+			return resp, nil
+		}
+
+		if err == nil {
+			err = fmt.Errorf("returned %s", resp.Status)
+			resp.Body.Close()
+		}
+		delay := f.settings.Backoff << attempt
+		klog.Infof("Retrying %s %s in %s: %v", method, rawURL, delay, err)
+		fetchMetrics.Add("retries", 1)
+		// Other requests to the host may proceed while this one waits
+		release()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Get sends GET request
+func (f *Fetcher) Get(ctx context.Context, rawURL string) (*http.Response, error) {
+	return f.Do(ctx, http.MethodGet, rawURL, nil)
+}
+
+// Head sends HEAD request
+func (f *Fetcher) Head(ctx context.Context, rawURL string) (*http.Response, error) {
+	return f.Do(ctx, http.MethodHead, rawURL, nil)
+}
@@ -0,0 +1,256 @@
+package promecieus
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func fetchCounter(name string) int64 {
+	if v, ok := fetchMetrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// flakyServer fails the first failures requests with the handler and succeeds afterwards
+func flakyServer(failures int32, fail http.HandlerFunc) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= failures {
+			fail(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return server, &requests
+}
+
+func resetConnection(w http.ResponseWriter, r *http.Request) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	conn.Close()
+}
+
+func TestFetcherRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		fail             http.HandlerFunc
+		failures         int32
+		expectedRequests int32
+		expectedStatus   int
+		expectedErr      bool
+	}{
+		{
+			name:             "server error is retried",
+			fail:             func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+			failures:         2,
+			expectedRequests: 3,
+			expectedStatus:   http.StatusOK,
+		},
+		{
+			name:             "rate limiting is retried",
+			fail:             func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTooManyRequests) },
+			failures:         1,
+			expectedRequests: 2,
+			expectedStatus:   http.StatusOK,
+		},
+		{
+			name:             "connection reset is retried",
+			fail:             resetConnection,
+			failures:         3,
+			expectedRequests: 4,
+			expectedStatus:   http.StatusOK,
+		},
+		{
+			name:             "client error is not retried",
+			fail:             func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotFound) },
+			failures:         1,
+			expectedRequests: 1,
+			expectedStatus:   http.StatusNotFound,
+		},
+		{
+			name:             "last server error is returned once retries are exhausted",
+			fail:             func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadGateway) },
+			failures:         10,
+			expectedRequests: 4,
+			expectedStatus:   http.StatusBadGateway,
+		},
+		{
+			name:             "last network error is returned once retries are exhausted",
+			fail:             resetConnection,
+			failures:         10,
+			expectedRequests: 4,
+			expectedErr:      true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, requests := flakyServer(tc.failures, tc.fail)
+			defer server.Close()
+			fetcher := NewFetcher(FetcherSettings{
+				Timeout:         5 * time.Second,
+				Retries:         3,
+				Backoff:         time.Millisecond,
+				HostConcurrency: 1,
+			})
+
+			retriesBefore := fetchCounter("retries")
+			resp, err := fetcher.Get(context.Background(), server.URL)
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatalf("expected error, got %s", resp.Status)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tc.expectedStatus {
+					t.Errorf("expected status %d, got %d", tc.expectedStatus, resp.StatusCode)
+				}
+			}
+			if requests.Load() != tc.expectedRequests {
+				t.Errorf("expected %d requests, got %d", tc.expectedRequests, requests.Load())
+			}
+			if retries := fetchCounter("retries") - retriesBefore; retries != int64(tc.expectedRequests-1) {
+				t.Errorf("expected %d retries to be counted, got %d", tc.expectedRequests-1, retries)
+			}
+			// Host slot is freed in every case
+			select {
+			case fetcher.hostSlots(server.Listener.Addr().String()) <- struct{}{}:
+			default:
+				t.Error("host slot was not released")
+			}
+		})
+	}
+}
+
+func TestFetcherDoesNotRetryPost(t *testing.T) {
+	server, requests := flakyServer(1, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) })
+	defer server.Close()
+	fetcher := NewFetcher(FetcherSettings{Timeout: 5 * time.Second, Retries: 3, Backoff: time.Millisecond, HostConcurrency: 1})
+
+	resp, err := fetcher.Do(context.Background(), http.MethodPost, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if requests.Load() != 1 {
+		t.Errorf("expected POST to be sent once, got %d requests", requests.Load())
+	}
+}
+
+func TestFetcherHostConcurrency(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+	fetcher := NewFetcher(FetcherSettings{Timeout: 5 * time.Second, Backoff: time.Millisecond, HostConcurrency: 2})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := fetcher.Get(context.Background(), server.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if maxInFlight.Load() != 2 {
+		t.Errorf("expected at most 2 concurrent requests to the host, got %d", maxInFlight.Load())
+	}
+}
+
+func TestFetcherReleasesSlotDuringBackoff(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/flaky" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	fetcher := NewFetcher(FetcherSettings{Timeout: 5 * time.Second, Retries: 1, Backoff: time.Second, HostConcurrency: 1})
+
+	flakyDone := make(chan struct{})
+	go func() {
+		defer close(flakyDone)
+		resp, err := fetcher.Get(context.Background(), server.URL+"/flaky")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	// Let the flaky request fail once and start waiting
+	time.Sleep(100 * time.Millisecond)
+
+	started := time.Now()
+	resp, err := fetcher.Get(context.Background(), server.URL+"/ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("request waited %s for a slot held by the retrying request", elapsed)
+	}
+	<-flakyDone
+}
+
+func TestFetcherCancelledDuringBackoff(t *testing.T) {
+	server, _ := flakyServer(10, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) })
+	defer server.Close()
+	fetcher := NewFetcher(FetcherSettings{Timeout: 5 * time.Second, Retries: 3, Backoff: time.Minute, HostConcurrency: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := fetcher.Get(ctx, server.URL); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	select {
+	case fetcher.hostSlots(server.Listener.Addr().String()) <- struct{}{}:
+	default:
+		t.Error("host slot was not released")
+	}
+}
+
+func TestFetcherMetrics(t *testing.T) {
+	server, _ := flakyServer(1, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) })
+	defer server.Close()
+	fetcher := NewFetcher(FetcherSettings{Timeout: 5 * time.Second, Retries: 1, Backoff: time.Millisecond, HostConcurrency: 1})
+
+	before := map[string]int64{}
+	names := []string{"requests", "retries", "errors", "status_200", "status_503", "in_flight"}
+	for _, name := range names {
+		before[name] = fetchCounter(name)
+	}
+	resp, err := fetcher.Get(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	expected := map[string]int64{"requests": 2, "retries": 1, "errors": 0, "status_200": 1, "status_503": 1, "in_flight": 0}
+	for _, name := range names {
+		if delta := fetchCounter(name) - before[name]; delta != expected[name] {
+			t.Errorf("expected %s to change by %d, got %d", name, expected[name], delta)
+		}
+	}
+}
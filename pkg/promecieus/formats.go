@@ -0,0 +1,68 @@
+package promecieus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ArchiveFormat is the container format of the metrics archive
+type ArchiveFormat string
+
+const (
+	FormatTar  ArchiveFormat = "tar"
+	FormatGzip ArchiveFormat = "gzip"
+	FormatZstd ArchiveFormat = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// detectArchiveFormat checks magic bytes at the start of the archive
+func detectArchiveFormat(header []byte) (ArchiveFormat, error) {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return FormatGzip, nil
+	case bytes.HasPrefix(header, zstdMagic):
+		return FormatZstd, nil
+	case isPlainTar(header):
+		return FormatTar, nil
+	}
+	return "", fmt.Errorf("unknown archive format, expected tar, gzip or zstd")
+}
+
+// isPlainTar checks for ustar magic in the first tar header
+func isPlainTar(header []byte) bool {
+	return len(header) >= 263 && bytes.Equal(header[257:262], []byte("ustar"))
+}
+
+// decompress wraps the reader with a matching decompressor
+func (f ArchiveFormat) decompress(r io.Reader) (io.ReadCloser, error) {
+	switch f {
+	case FormatGzip:
+		return gzip.NewReader(r)
+	case FormatZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return io.NopCloser(r), nil
+}
+
+// tarFlags returns tar options which extract the archive in the init container.
+// Archives with unknown format are assumed to be gzipped, zstd archives are
+// decompressed by promecieus as the fetcher image has no zstd
+func (f ArchiveFormat) tarFlags() string {
+	switch f {
+	case FormatTar, FormatZstd:
+		return "xv"
+	}
+	return "xvz"
+}
@@ -0,0 +1,182 @@
+package promecieus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	gcsAPIPrefix = storagePrefix + "/storage/v1"
+	gcsWebPath   = "/gcs/"
+)
+
+// gcsObject is a single file found in the bucket
+type gcsObject struct {
+	Name    string
+	Size    int64
+	Updated time.Time
+}
+
+// gcsListing is the content of a single bucket folder.
+// Prefixes are full paths of subfolders and always end with a slash
+type gcsListing struct {
+	Prefixes []string
+	Objects  []gcsObject
+}
+
+// artifactLister lists a single folder of a bucket
+type artifactLister interface {
+	List(ctx context.Context, bucket, prefix string) (*gcsListing, error)
+}
+
+// newGCSLister returns a lister which uses JSON API and falls back to gcsweb scraping
+func newGCSLister(fetcher *Fetcher) artifactLister {
+	return &fallbackLister{
+		primary:  &gcsJSONLister{fetcher: fetcher, apiURL: gcsAPIPrefix},
+		fallback: &gcsHTMLLister{fetcher: fetcher, baseURL: gcsPrefix},
+	}
+}
+
+// gcsObjectURL returns a fetchable URL for an object in the bucket
+func gcsObjectURL(bucket, name string) string {
+	return fmt.Sprintf("%s/%s/%s", storagePrefix, bucket, name)
+}
+
+// gcsStore builds GCS download links for objects found by the lister
+type gcsStore struct {
+	artifactLister
+}
+
+func (g *gcsStore) ObjectURL(bucket, name string) string {
+	return gcsObjectURL(bucket, name)
+}
+
+// folderName returns the last segment of a folder path
+func folderName(prefix string) string {
+	return path.Base(strings.TrimSuffix(prefix, "/"))
+}
+
+// gcsJSONLister lists objects using storage/v1 JSON API
+type gcsJSONLister struct {
+	fetcher *Fetcher
+	apiURL  string
+}
+
+type gcsJSONObject struct {
+	Name    string    `json:"name"`
+	Size    string    `json:"size"`
+	Updated time.Time `json:"updated"`
+}
+
+type gcsJSONResponse struct {
+	Prefixes      []string        `json:"prefixes"`
+	Items         []gcsJSONObject `json:"items"`
+	NextPageToken string          `json:"nextPageToken"`
+}
+
+func (g *gcsJSONLister) List(ctx context.Context, bucket, prefix string) (*gcsListing, error) {
+	listing := &gcsListing{}
+	pageToken := ""
+	for {
+		params := url.Values{}
+		params.Set("prefix", prefix)
+		params.Set("delimiter", "/")
+		params.Set("fields", "prefixes,items(name,size,updated),nextPageToken")
+		if pageToken != "" {
+			params.Set("pageToken", pageToken)
+		}
+		apiURL := fmt.Sprintf("%s/b/%s/o?%s", g.apiURL, url.PathEscape(bucket), params.Encode())
+
+		resp, err := g.fetcher.Get(ctx, apiURL)
+		if err != nil {
+			return nil, err
+		}
+		var page gcsJSONResponse
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to list %s: returned %s", apiURL, resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal listing at %s: %v", apiURL, err)
+		}
+
+		listing.Prefixes = append(listing.Prefixes, page.Prefixes...)
+		for _, item := range page.Items {
+			size, err := strconv.ParseInt(item.Size, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size %q for %s: %v", item.Size, item.Name, err)
+			}
+			listing.Objects = append(listing.Objects, gcsObject{
+				Name:    item.Name,
+				Size:    size,
+				Updated: item.Updated,
+			})
+		}
+
+		if page.NextPageToken == "" {
+			return listing, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// gcsHTMLLister scrapes gcsweb folder pages. It doesn't know object sizes and timestamps
+type gcsHTMLLister struct {
+	fetcher *Fetcher
+	baseURL string
+}
+
+func (g *gcsHTMLLister) List(ctx context.Context, bucket, prefix string) (*gcsListing, error) {
+	folderPath := gcsWebPath + bucket + "/" + prefix
+	links, err := g.fetcher.getLinksFromURL(ctx, g.baseURL+folderPath)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := &gcsListing{}
+	for _, link := range links {
+		// gcsweb links may be relative or absolute
+		if u, err := url.Parse(link); err == nil && u.Path != "" {
+			link = u.Path
+		}
+		// Skip parent folder and unrelated links
+		if !strings.HasPrefix(link, folderPath) || len(link) == len(folderPath) {
+			continue
+		}
+		name := strings.TrimPrefix(link, gcsWebPath+bucket+"/")
+		if strings.HasSuffix(name, "/") {
+			listing.Prefixes = append(listing.Prefixes, name)
+		} else {
+			listing.Objects = append(listing.Objects, gcsObject{Name: name})
+		}
+	}
+	return listing, nil
+}
+
+// fallbackLister uses the primary lister and switches to fallback when primary is unavailable
+type fallbackLister struct {
+	primary  artifactLister
+	fallback artifactLister
+}
+
+func (f *fallbackLister) List(ctx context.Context, bucket, prefix string) (*gcsListing, error) {
+	listing, err := f.primary.List(ctx, bucket, prefix)
+	if err == nil {
+		return listing, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	klog.Warningf("GCS JSON API unavailable, falling back to gcsweb: %v", err)
+	return f.fallback.List(ctx, bucket, prefix)
+}
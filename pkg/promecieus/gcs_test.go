@@ -0,0 +1,155 @@
+package promecieus
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testFetcher() *Fetcher {
+	return NewFetcher(FetcherSettings{
+		Timeout:         5 * time.Second,
+		Backoff:         time.Millisecond,
+		HostConcurrency: 4,
+	})
+}
+
+// stubLister records calls and returns a fixed listing
+type stubLister struct {
+	listing *gcsListing
+	err     error
+	calls   int
+}
+
+func (s *stubLister) List(ctx context.Context, bucket, prefix string) (*gcsListing, error) {
+	s.calls++
+	return s.listing, s.err
+}
+
+func TestGCSJSONListerPagination(t *testing.T) {
+	var requests []string
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/b/origin-ci-test/o" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		q := r.URL.Query()
+		if q.Get("delimiter") != "/" || q.Get("prefix") != "logs/job/1/" {
+			t.Errorf("unexpected query %s", r.URL.RawQuery)
+		}
+		requests = append(requests, q.Get("pageToken"))
+		switch q.Get("pageToken") {
+		case "":
+			fmt.Fprint(w, `{"prefixes": ["logs/job/1/artifacts/"],
+				"items": [{"name": "logs/job/1/started.json", "size": "10", "updated": "2024-01-01T00:00:00Z"}],
+				"nextPageToken": "page2"}`)
+		case "page2":
+			fmt.Fprint(w, `{"prefixes": ["logs/job/1/metrics/"],
+				"items": [{"name": "logs/job/1/finished.json", "size": "20", "updated": "2024-01-01T01:00:00Z"}]}`)
+		default:
+			t.Errorf("unexpected page token %s", q.Get("pageToken"))
+		}
+	}))
+	defer bucket.Close()
+
+	lister := &gcsJSONLister{fetcher: testFetcher(), apiURL: bucket.URL}
+	listing, err := lister.List(context.Background(), "origin-ci-test", "logs/job/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(requests, []string{"", "page2"}) {
+		t.Errorf("expected two pages to be requested, got %q", requests)
+	}
+	expected := &gcsListing{
+		Prefixes: []string{"logs/job/1/artifacts/", "logs/job/1/metrics/"},
+		Objects: []gcsObject{
+			{Name: "logs/job/1/started.json", Size: 10, Updated: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+			{Name: "logs/job/1/finished.json", Size: 20, Updated: time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)},
+		},
+	}
+	if !reflect.DeepEqual(listing, expected) {
+		t.Errorf("expected %+v, got %+v", expected, listing)
+	}
+}
+
+func TestGCSJSONListerError(t *testing.T) {
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "forbidden"}`, http.StatusForbidden)
+	}))
+	defer bucket.Close()
+
+	lister := &gcsJSONLister{fetcher: testFetcher(), apiURL: bucket.URL}
+	if _, err := lister.List(context.Background(), "origin-ci-test", "logs/"); err == nil {
+		t.Error("expected error for forbidden listing")
+	}
+}
+
+func TestGCSHTMLListerPrefixes(t *testing.T) {
+	gcsweb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gcs/origin-ci-test/logs/job/1/" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		fmt.Fprint(w, `<html><body>
+			<a href="/gcs/origin-ci-test/logs/job/">..</a>
+			<a href="/gcs/origin-ci-test/logs/job/1/artifacts/">artifacts/</a>
+			<a href="https://gcsweb.example.com/gcs/origin-ci-test/logs/job/1/build-log.txt">build-log.txt</a>
+			<a href="https://example.com/unrelated">unrelated</a>
+		</body></html>`)
+	}))
+	defer gcsweb.Close()
+
+	lister := &gcsHTMLLister{fetcher: testFetcher(), baseURL: gcsweb.URL}
+	listing, err := lister.List(context.Background(), "origin-ci-test", "logs/job/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &gcsListing{
+		Prefixes: []string{"logs/job/1/artifacts/"},
+		Objects:  []gcsObject{{Name: "logs/job/1/build-log.txt"}},
+	}
+	if !reflect.DeepEqual(listing, expected) {
+		t.Errorf("expected %+v, got %+v", expected, listing)
+	}
+}
+
+func TestFallbackListerUsesGCSWebOnAPIError(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer api.Close()
+	gcsweb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<a href="/gcs/origin-ci-test/logs/job/1/metrics/">metrics/</a>`)
+	}))
+	defer gcsweb.Close()
+
+	fetcher := testFetcher()
+	lister := &fallbackLister{
+		primary:  &gcsJSONLister{fetcher: fetcher, apiURL: api.URL},
+		fallback: &gcsHTMLLister{fetcher: fetcher, baseURL: gcsweb.URL},
+	}
+	listing, err := lister.List(context.Background(), "origin-ci-test", "logs/job/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(listing.Prefixes, []string{"logs/job/1/metrics/"}) {
+		t.Errorf("expected listing from gcsweb, got %+v", listing)
+	}
+}
+
+func TestFallbackListerStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	primary := &stubLister{err: fmt.Errorf("request cancelled")}
+	fallback := &stubLister{listing: &gcsListing{}}
+	lister := &fallbackLister{primary: primary, fallback: fallback}
+
+	cancel()
+	if _, err := lister.List(ctx, "origin-ci-test", "logs/"); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if fallback.calls != 0 {
+		t.Errorf("expected no fallback once cancelled, got %d calls", fallback.calls)
+	}
+}
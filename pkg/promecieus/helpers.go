@@ -1,27 +1,25 @@
 package promecieus
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
 	"net/url"
-	"path"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"golang.org/x/net/html"
-	"k8s.io/klog/v2"
 )
 
 const (
 	charset             = "abcdefghijklmnopqrstuvwxyz"
 	randLength          = 8
 	promTemplates       = "prom-templates"
-	gcsLinkToken        = "gcsweb"
 	gcsPrefix           = "https://gcsweb-ci.apps.ci.l2s4.p1.openshiftapps.com"
 	storagePrefix       = "https://storage.googleapis.com"
 	artifactsPath       = "artifacts"
@@ -42,17 +40,17 @@ func generateAppLabel() string {
 	return string(b)
 }
 
-func getLinksFromURL(url string) ([]string, error) {
+func (f *Fetcher) getLinksFromURL(ctx context.Context, url string) ([]string, error) {
 	links := []string{}
 
-	var netClient = &http.Client{
-		Timeout: time.Second * 10,
-	}
-	resp, err := netClient.Get(url)
+	resp, err := f.Get(ctx, url)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch %s: %v", url, err)
+		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: returned %s", url, resp.Status)
+	}
 
 	z := html.NewTokenizer(resp.Body)
 	for {
@@ -78,272 +76,394 @@ func getLinksFromURL(url string) ([]string, error) {
 	}
 }
 
-func getMetricsTar(conn *websocket.Conn, url *url.URL) (ProwInfo, error) {
+func (s *ServerSettings) getMetricsTar(ctx context.Context, conn *websocket.Conn, appLabel string, url *url.URL) (ProwInfo, error) {
 	sendWSMessage(conn, "status", fmt.Sprintf("Fetching %s", url))
 
-	prowInfo, err := getTarURLFromProw(conn, url)
+	resolver, err := s.Resolvers.Find(url)
+	if err != nil {
+		return ProwInfo{}, err
+	}
+	sendWSMessage(conn, "status", fmt.Sprintf("Looking for prometheus archive using %s resolver", resolver.Name()))
+
+	prowInfo, err := resolver.Resolve(ctx, url)
 	if err != nil {
 		return prowInfo, err
 	}
-	expectedMetricsURL := prowInfo.MetricsURL
+	if len(prowInfo.Candidates) > 1 {
+		if err := s.selectCandidate(ctx, conn, appLabel, url, &prowInfo); err != nil {
+			return prowInfo, err
+		}
+	}
+	if err := s.pickReplica(ctx, conn, url, &prowInfo); err != nil {
+		return prowInfo, err
+	}
+	if prowInfo.Pair != nil {
+		if err := s.pickReplica(ctx, conn, url, prowInfo.Pair); err != nil {
+			return prowInfo, err
+		}
+	}
+	// Instances of the same archives are reused, no need to check and stage archives again
+	if s.instanceAvailable(ctx, &prowInfo) && (prowInfo.Pair == nil || s.instanceAvailable(ctx, prowInfo.Pair)) {
+		return prowInfo, nil
+	}
+	err = s.validateArchives(ctx, conn, &prowInfo)
+	return prowInfo, err
+}
+
+// validateArchives checks archives of the instance and its pair, picks resources and stages data for init containers
+func (s *ServerSettings) validateArchives(ctx context.Context, conn *websocket.Conn, prowInfo *ProwInfo) error {
+	if err := s.stageBundles(prowInfo); err != nil {
+		return err
+	}
+	archives := prowInfo.archives()
+	if prowInfo.Pair != nil {
+		if err := s.stageBundles(prowInfo.Pair); err != nil {
+			return err
+		}
+		archives = append(archives, prowInfo.Pair.archives()...)
+	}
+
+	// Make sure archives are TSDB snapshots before any pods are scheduled
+	contents := map[string]*archiveContents{}
+	for _, archive := range archives {
+		sendWSMessage(conn, "status", fmt.Sprintf("Found prometheus archive at %s", archive.URL))
+		sendWSMessage(conn, "status", "Checking if prometheus archive is valid")
+		c, err := s.Fetcher.validateArchive(ctx, archive.fetchURL())
+		if err != nil {
+			return err
+		}
+		sendWSMessage(conn, "status", fmt.Sprintf("Found %s", c))
+		contents[archive.URL] = c
+	}
 
-	sendWSMessage(conn, "status", fmt.Sprintf("Found prometheus archive at %s", expectedMetricsURL))
+	prowInfo.setFormats(contents)
+	updateTimeRange(conn, prowInfo, contents)
+	if prowInfo.Pair != nil {
+		prowInfo.Pair.setFormats(contents)
+		updateTimeRange(conn, prowInfo.Pair, contents)
+	}
 
-	// Check that metrics/prometheus.tar can be fetched and it non-null
-	sendWSMessage(conn, "status", "Checking if prometheus archive can be fetched")
-	var netClient = &http.Client{
-		Timeout: time.Second * 10,
+	// Refuse archives which would never fit before anything is staged or scheduled
+	if err := s.sizeInstance(conn, prowInfo, contents); err != nil {
+		return err
+	}
+	sizings := []*InstanceSizing{prowInfo.Sizing}
+	if prowInfo.Pair != nil {
+		if err := s.sizeInstance(conn, prowInfo.Pair, contents); err != nil {
+			return err
+		}
+		sizings = append(sizings, prowInfo.Pair.Sizing)
+	}
+	if err := s.checkQuota(sizings...); err != nil {
+		return err
+	}
+	if err := s.stageDecompression(conn, prowInfo); err != nil {
+		return err
+	}
+	if prowInfo.Pair != nil {
+		if err := s.stageDecompression(conn, prowInfo.Pair); err != nil {
+			return err
+		}
+	}
+	if err := s.stagePresigned(prowInfo); err != nil {
+		return err
+	}
+	if prowInfo.Pair != nil {
+		if err := s.stagePresigned(prowInfo.Pair); err != nil {
+			return err
+		}
 	}
-	resp, err := netClient.Head(expectedMetricsURL)
+	s.stageBackfill(ctx, conn, prowInfo)
+	if prowInfo.Pair != nil {
+		s.stageBackfill(ctx, conn, prowInfo.Pair)
+	}
+	prowInfo.validated = true
+	if prowInfo.Pair != nil {
+		prowInfo.Pair.validated = true
+	}
+	return nil
+}
+
+// archiveHead is archive metadata returned by HEAD request
+type archiveHead struct {
+	Size         int64
+	LastModified time.Time
+	AcceptRanges bool
+}
+
+// checkArchive verifies that archive can be fetched and returns its metadata
+func (f *Fetcher) checkArchive(ctx context.Context, expectedMetricsURL string) (archiveHead, error) {
+	head := archiveHead{}
+	resp, err := f.Head(ctx, expectedMetricsURL)
 	if err != nil {
-		return prowInfo, fmt.Errorf("failed to fetch %s: %v", expectedMetricsURL, err)
+		return head, err
 	}
 	defer resp.Body.Close()
 
+	// Presigned links are valid for GET requests only
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusMethodNotAllowed {
+		return f.checkArchiveWithGet(ctx, expectedMetricsURL)
+	}
+
 	if resp.StatusCode != 200 {
-		return prowInfo, fmt.Errorf("failed to check archive at %s: returned %s", expectedMetricsURL, resp.Status)
+		return head, fmt.Errorf("failed to check archive at %s: returned %s", expectedMetricsURL, resp.Status)
 	}
 
 	contentLength := resp.Header.Get("content-length")
 	if contentLength == "" {
-		return prowInfo, fmt.Errorf("failed to check archive at %s: no content length returned", expectedMetricsURL)
+		return head, fmt.Errorf("failed to check archive at %s: no content length returned", expectedMetricsURL)
 	}
-	length, err := strconv.Atoi(contentLength)
+	length, err := strconv.ParseInt(contentLength, 10, 64)
 	if err != nil {
-		return prowInfo, fmt.Errorf("failed to check archive at %s: invalid content-length: %v", expectedMetricsURL, err)
+		return head, fmt.Errorf("failed to check archive at %s: invalid content-length: %v", expectedMetricsURL, err)
 	}
 	if length == 0 {
-		return prowInfo, fmt.Errorf("failed to check archive at %s: archive is empty", expectedMetricsURL)
+		return head, fmt.Errorf("failed to check archive at %s: archive is empty", expectedMetricsURL)
 	}
-	return prowInfo, nil
-}
-
-func getTarURLFromProw(conn *websocket.Conn, baseURL *url.URL) (ProwInfo, error) {
-	prowInfo := ProwInfo{}
-
-	// Is it a direct prom tarball link?
-	if strings.HasSuffix(baseURL.Path, promTarPath) || strings.HasSuffix(baseURL.Path, prom2ndTarPath) {
-		// Make it a fetchable URL if it's a gcsweb URL
-		tempMetricsURL := strings.Replace(baseURL.String(), gcsPrefix+"/gcs", storagePrefix, -1)
-		prowInfo.MetricsURL = tempMetricsURL
-		// there is no way to find out the time via direct tarball link, use current time
-		prowInfo.Finished = time.Now()
-		prowInfo.Started = time.Now()
-		return prowInfo, nil
+	head.Size = length
+	head.AcceptRanges = resp.Header.Get("accept-ranges") == "bytes"
+	if lastModified, err := http.ParseTime(resp.Header.Get("last-modified")); err == nil {
+		head.LastModified = lastModified
 	}
+	return head, nil
+}
 
-	// Get a list of links on prow page
-	prowToplinks, err := getLinksFromURL(baseURL.String())
+// checkArchiveWithGet reads archive metadata by fetching its first byte
+func (f *Fetcher) checkArchiveWithGet(ctx context.Context, expectedMetricsURL string) (archiveHead, error) {
+	head := archiveHead{}
+	resp, err := f.Do(ctx, http.MethodGet, expectedMetricsURL, http.Header{"Range": []string{"bytes=0-0"}})
 	if err != nil {
-		return prowInfo, fmt.Errorf("failed to find links at %s: %v", prowToplinks, err)
+		return head, err
 	}
-	if len(prowToplinks) == 0 {
-		return prowInfo, fmt.Errorf("no links found at %s", baseURL)
-	}
-	gcsTempURL := ""
-	for _, link := range prowToplinks {
-		klog.Infof("link: %s", link)
-		if strings.Contains(link, gcsLinkToken) {
-			gcsTempURL = link
-			break
-		}
-	}
-	if gcsTempURL == "" {
-		return prowInfo, fmt.Errorf("failed to find GCS link in %v", prowToplinks)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return head, fmt.Errorf("failed to check archive at %s: returned %s", expectedMetricsURL, resp.Status)
 	}
-	sendWSMessage(conn, "status", fmt.Sprintf("Found gcs link at %s", baseURL))
 
-	gcsURL, err := url.Parse(gcsTempURL)
+	// Content-Range is "bytes 0-0/<size>"
+	contentRange := resp.Header.Get("content-range")
+	length, err := strconv.ParseInt(contentRange[strings.LastIndex(contentRange, "/")+1:], 10, 64)
 	if err != nil {
-		return prowInfo, fmt.Errorf("failed to parse GCS URL %s: %v", gcsTempURL, err)
+		return head, fmt.Errorf("failed to check archive at %s: invalid content-range %q", expectedMetricsURL, contentRange)
 	}
-
-	// Fetch start and finish time of the test
-	startTime, err := getTimeStampFromProwJSON(fmt.Sprintf("%s/started.json", gcsURL))
-	if err != nil {
-		return prowInfo, fmt.Errorf("failed to fetch test start time: %v", err)
+	if length == 0 {
+		return head, fmt.Errorf("failed to check archive at %s: archive is empty", expectedMetricsURL)
 	}
-	prowInfo.Started = startTime
-
-	finishedTime, err := getTimeStampFromProwJSON(fmt.Sprintf("%s/finished.json", gcsURL))
-	if err != nil {
-		return prowInfo, fmt.Errorf("failed to fetch test finished time: %v", err)
+	head.Size = length
+	head.AcceptRanges = true
+	if lastModified, err := http.ParseTime(resp.Header.Get("last-modified")); err == nil {
+		head.LastModified = lastModified
 	}
-	prowInfo.Finished = finishedTime
+	return head, nil
+}
 
-	sendWSMessage(conn, "status", fmt.Sprintf("Found start/stop markers at %s", gcsURL))
+// updateTimeRange replaces test start/finish markers with the range of data in the archives.
+// Recent data is kept in WAL, so archive upload time is used as the end of range in this case.
+// Blocks of partially read archives may be missing, so markers are only widened then
+func updateTimeRange(conn *websocket.Conn, prowInfo *ProwInfo, contents map[string]*archiveContents) {
+	blocks := []blockMeta{}
+	hasWAL, partial := false, false
+	var lastModified time.Time
+	for _, archive := range prowInfo.archives() {
+		c, ok := contents[archive.URL]
+		if !ok {
+			return
+		}
+		if c.Head.LastModified.After(lastModified) {
+			lastModified = c.Head.LastModified
+		}
+		blocks = append(blocks, c.Blocks...)
+		hasWAL = hasWAL || c.HasWAL
+		partial = partial || c.Partial
+	}
 
-	// Check that 'artifacts' folder is present
-	gcsToplinks, err := getLinksFromURL(gcsURL.String())
-	if err != nil {
-		return prowInfo, fmt.Errorf("failed to fetch top-level GCS link at %s: %v", gcsURL, err)
+	summary := summarizeBlocks(blocks)
+	if summary.Blocks == 0 {
+		// Direct links have no markers, archive upload time is the best guess
+		if prowInfo.Job == nil && !lastModified.IsZero() {
+			prowInfo.Started, prowInfo.Finished = lastModified, lastModified
+		}
+		return
 	}
-	if len(gcsToplinks) == 0 {
-		return prowInfo, fmt.Errorf("no top-level GCS links at %s found", gcsURL)
+	started, finished := summary.MinTime, summary.MaxTime
+	if hasWAL && lastModified.After(finished) {
+		finished = lastModified
 	}
-	tmpArtifactsURL := ""
-	for _, link := range gcsToplinks {
-		if strings.HasSuffix(link, "artifacts/") {
-			tmpArtifactsURL = gcsPrefix + link
-			break
-		}
+	if !partial {
+		prowInfo.Started, prowInfo.Finished = started, finished
+		sendWSMessage(conn, "status", fmt.Sprintf("Using data range from %s to %s",
+			prowInfo.Started.UTC().Format(time.RFC3339), prowInfo.Finished.UTC().Format(time.RFC3339)))
+		return
 	}
-	if tmpArtifactsURL == "" {
-		return prowInfo, fmt.Errorf("failed to find artifacts link in %v", gcsToplinks)
+	if prowInfo.Started.IsZero() || started.Before(prowInfo.Started) {
+		prowInfo.Started = started
 	}
-	artifactsURL, err := url.Parse(tmpArtifactsURL)
+	if finished.After(prowInfo.Finished) {
+		prowInfo.Finished = finished
+	}
+	sendWSMessage(conn, "status", fmt.Sprintf("Archive was read partially, so blocks found may not cover all data. Using range from %s to %s",
+		prowInfo.Started.UTC().Format(time.RFC3339), prowInfo.Finished.UTC().Format(time.RFC3339)))
+}
+
+func (f *Fetcher) getTimeStampFromProwJSON(ctx context.Context, rawURL string) (time.Time, error) {
+	jsonURL, err := url.Parse(rawURL)
 	if err != nil {
-		return prowInfo, fmt.Errorf("failed to parse artifacts link %s: %v", tmpArtifactsURL, err)
+		return time.Now(), fmt.Errorf("failed to fetch prow JSOM at %s: %v", rawURL, err)
 	}
 
-	// Get a list of folders in find ones which contain e2e
-	artifactLinksToplinks, err := getLinksFromURL(artifactsURL.String())
+	resp, err := f.Get(ctx, jsonURL.String())
 	if err != nil {
-		return prowInfo, fmt.Errorf("failed to fetch artifacts link at %s: %v", gcsURL, err)
-	}
-	if len(artifactLinksToplinks) == 0 {
-		return prowInfo, fmt.Errorf("no artifact links at %s found", gcsURL)
-	}
-	tmpE2eURL := ""
-	for _, link := range artifactLinksToplinks {
-		klog.Infof("link: %s", link)
-		linkSplitBySlash := strings.Split(link, "/")
-		lastPathSegment := linkSplitBySlash[len(linkSplitBySlash)-1]
-		if len(lastPathSegment) == 0 {
-			lastPathSegment = linkSplitBySlash[len(linkSplitBySlash)-2]
-		}
-		klog.Infof("lastPathSection: %s", lastPathSegment)
-		if strings.Contains(lastPathSegment, e2ePrefix) {
-			tmpE2eURL = gcsPrefix + link
-			break
-		}
+		return time.Now(), err
 	}
-	if tmpE2eURL == "" {
-		return prowInfo, fmt.Errorf("failed to find e2e link in %v", artifactLinksToplinks)
+	defer resp.Body.Close()
+
+	body, readErr := io.ReadAll(resp.Body)
+	if readErr != nil {
+		return time.Now(), fmt.Errorf("failed to read body at %s: %v", jsonURL.String(), err)
 	}
-	e2eURL, err := url.Parse(tmpE2eURL)
+
+	var prowInfo ProwJSON
+	err = json.Unmarshal(body, &prowInfo)
 	if err != nil {
-		return prowInfo, fmt.Errorf("failed to parse e2e link %s: %v", tmpE2eURL, err)
+		return time.Now(), fmt.Errorf("failed to unmarshal json %s: %v", body, err)
 	}
 
-	// Support new-style jobs - look for gather-extra
-	var gatherExtraURL *url.URL
+	return time.Unix(int64(prowInfo.Timestamp), 0), nil
+}
 
-	e2eToplinks, err := getLinksFromURL(e2eURL.String())
+// getTextFromURL fetches a small text file, like latest-build.txt
+func (f *Fetcher) getTextFromURL(ctx context.Context, rawURL string) (string, error) {
+	resp, err := f.Get(ctx, rawURL)
 	if err != nil {
-		return prowInfo, fmt.Errorf("failed to fetch artifacts link at %s: %v", e2eURL, err)
+		return "", err
 	}
-	if len(e2eToplinks) == 0 {
-		return prowInfo, fmt.Errorf("no top links at %s found", e2eURL)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch %s: returned %s", rawURL, resp.Status)
 	}
 
-	var candidates []*url.URL
-	for _, link := range e2eToplinks {
-		klog.Infof("link: %s", link)
-		linkSplitBySlash := strings.Split(link, "/")
-		lastPathSegment := linkSplitBySlash[len(linkSplitBySlash)-1]
-		if len(lastPathSegment) == 0 {
-			lastPathSegment = linkSplitBySlash[len(linkSplitBySlash)-2]
-		}
-		klog.Infof("lastPathSection: %s", lastPathSegment)
-		switch lastPathSegment {
-		case "artifacts":
-			continue
-		case "gsutil":
-			continue
-		default:
-			u, err := url.Parse(gcsPrefix + link)
-			if err != nil {
-				return prowInfo, fmt.Errorf("failed to parse e2e link %s: %v", tmpE2eURL, err)
-			}
-			candidates = append(candidates, u)
-		}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read body at %s: %v", rawURL, err)
 	}
+	return strings.TrimSpace(string(body)), nil
+}
 
-	switch len(candidates) {
-	case 0:
-		break
-	case 1:
-		gatherExtraURL = candidates[0]
-	default:
-		for _, u := range candidates {
-			base := path.Base(u.Path)
-			if base == extraPath || base == hypershiftExtraPath {
-				gatherExtraURL = u
-				break
-			}
+// setFormats stores detected archive formats, so that extraction would use a matching decompressor
+func (p *ProwInfo) setFormats(contents map[string]*archiveContents) {
+	archives := p.archives()
+	for i := range archives {
+		if c, ok := contents[archives[i].URL]; ok {
+			archives[i].Format = c.Format
 		}
 	}
+	p.Archives = archives
+}
 
-	if gatherExtraURL != nil {
-		// New-style jobs may not have metrics available
-		e2eToplinks, err = getLinksFromURL(gatherExtraURL.String())
-		if err != nil {
-			return prowInfo, fmt.Errorf("failed to fetch gather-extra link at %s: %v", e2eURL, err)
+// stageBundles serves unpacked data directories as tar archives via staging
+func (s *ServerSettings) stageBundles(p *ProwInfo) error {
+	archives := p.archives()
+	for i := range archives {
+		if len(archives[i].Files) == 0 {
+			continue
 		}
-		if len(e2eToplinks) == 0 {
-			return prowInfo, fmt.Errorf("no top links at %s found", e2eURL)
+		if s.Staging == nil {
+			return fmt.Errorf("data directory %s requires staging to be archived", archives[i].URL)
 		}
-		for _, link := range e2eToplinks {
-			klog.Infof("link: %s", link)
-			linkSplitBySlash := strings.Split(link, "/")
-			lastPathSegment := linkSplitBySlash[len(linkSplitBySlash)-1]
-			if len(lastPathSegment) == 0 {
-				lastPathSegment = linkSplitBySlash[len(linkSplitBySlash)-2]
-			}
-			klog.Infof("lastPathSection: %s", lastPathSegment)
-			if lastPathSegment == artifactsPath {
-				tmpGatherExtraURL := gcsPrefix + link
-				gatherExtraURL, err = url.Parse(tmpGatherExtraURL)
-				if err != nil {
-					return prowInfo, fmt.Errorf("failed to parse e2e link %s: %v", tmpE2eURL, err)
-				}
-				break
-			}
+		token, err := s.Staging.Bundle(archives[i].Files)
+		if err != nil {
+			return fmt.Errorf("failed to stage %s: %v", archives[i].URL, err)
 		}
-		e2eURL = gatherExtraURL
+		archives[i].StagedURL = s.Staging.URL(token)
 	}
+	p.Archives = archives
+	return nil
+}
 
-	tarFile := promTarPath
-	if baseURL.Query().Has("altsnap") {
-		tarFile = prom2ndTarPath
+// stageDecompression serves zstd archives as plain tar via staging, as the fetcher image has no zstd
+func (s *ServerSettings) stageDecompression(conn *websocket.Conn, p *ProwInfo) error {
+	archives := p.archives()
+	for i := range archives {
+		if archives[i].Format != FormatZstd {
+			continue
+		}
+		if s.Staging == nil {
+			return fmt.Errorf("zstd archive %s requires staging to be decompressed", archives[i].URL)
+		}
+		token, err := s.Staging.Decompress(archives[i].URL, archives[i].Format)
+		if err != nil {
+			return fmt.Errorf("failed to stage %s for decompression: %v", archives[i].URL, err)
+		}
+		archives[i].StagedURL = s.Staging.URL(token)
+		sendWSMessage(conn, "status", fmt.Sprintf("Archive %s will be decompressed by promecieus", archives[i].URL))
 	}
+	p.Archives = archives
+	return nil
+}
 
-	gcsMetricsURL := fmt.Sprintf("%s%s", e2eURL.String(), tarFile)
-	tempMetricsURL := strings.Replace(gcsMetricsURL, gcsPrefix+"/gcs", storagePrefix, -1)
-	expectedMetricsURL, err := url.Parse(tempMetricsURL)
-	if err != nil {
-		return prowInfo, fmt.Errorf("failed to parse metrics link %s: %v", tempMetricsURL, err)
+// stagePresigned proxies presigned archives via staging, so that credentials are not kept in the Deployment
+func (s *ServerSettings) stagePresigned(p *ProwInfo) error {
+	archives := p.archives()
+	for i := range archives {
+		if archives[i].StagedURL != "" || !isPresignedURL(archives[i].URL) {
+			continue
+		}
+		if s.Staging == nil {
+			return fmt.Errorf("presigned archive %s requires staging to be proxied", redactPresigned(archives[i].URL))
+		}
+		token, err := s.Staging.Proxy(archives[i].URL)
+		if err != nil {
+			return fmt.Errorf("failed to stage %s: %v", redactPresigned(archives[i].URL), err)
+		}
+		archives[i].StagedURL = s.Staging.URL(token)
 	}
-	prowInfo.MetricsURL = expectedMetricsURL.String()
-	return prowInfo, nil
+	p.Archives = archives
+	return nil
 }
 
-func getTimeStampFromProwJSON(rawURL string) (time.Time, error) {
-	jsonURL, err := url.Parse(rawURL)
-	if err != nil {
-		return time.Now(), fmt.Errorf("failed to fetch prow JSOM at %s: %v", rawURL, err)
+// useCandidate points ProwInfo to the selected archive
+func (p *ProwInfo) useCandidate(c MetricsCandidate) {
+	p.MetricsURL = c.URL
+	p.Size = c.Size
+	p.ReplicaURL = c.ReplicaURL
+	p.ReplicaSize = c.ReplicaSize
+	p.Cluster = c.Cluster
+	if p.MetricsURL == "" {
+		p.MetricsURL, p.Size = p.ReplicaURL, p.ReplicaSize
+		p.ReplicaURL, p.ReplicaSize = "", 0
+	}
+	if p.artifacts != nil {
+		p.Failures = testFailures(p.artifacts.failures, c.Test)
+		p.Backfill = testBackfill(p.artifacts.backfill, c)
+	}
+	// Metadata may be shared with the pair, which shows metrics of its own test
+	if p.Metadata != nil {
+		metadata := *p.Metadata
+		metadata.JobMetrics = c.jobMetrics
+		p.Metadata = &metadata
 	}
+}
 
-	var netClient = &http.Client{
-		Timeout: time.Second * 10,
-	}
-	resp, err := netClient.Get(jsonURL.String())
-	if err != nil {
-		return time.Now(), fmt.Errorf("failed to fetch %s: %v", jsonURL.String(), err)
+// instanceName is app label with a cluster kind, if any
+func (p *ProwInfo) instanceName(appLabel string) string {
+	if p.Cluster == "" {
+		return appLabel
 	}
-	defer resp.Body.Close()
+	return fmt.Sprintf("%s (%s cluster)", appLabel, p.Cluster)
+}
 
-	body, readErr := io.ReadAll(resp.Body)
-	if readErr != nil {
-		return time.Now(), fmt.Errorf("failed to read body at %s: %v", jsonURL.String(), err)
+// fetchURL is the link init container downloads the archive from
+func (a MetricsArchive) fetchURL() string {
+	if a.StagedURL != "" {
+		return a.StagedURL
 	}
+	return a.URL
+}
 
-	var prowInfo ProwJSON
-	err = json.Unmarshal(body, &prowInfo)
-	if err != nil {
-		return time.Now(), fmt.Errorf("failed to unmarshal json %s: %v", body, err)
+// archives returns a list of archives to be extracted into the instance
+func (p *ProwInfo) archives() []MetricsArchive {
+	if len(p.Archives) > 0 {
+		return p.Archives
 	}
-
-	return time.Unix(int64(prowInfo.Timestamp), 0), nil
+	return []MetricsArchive{{URL: p.MetricsURL}}
 }
@@ -0,0 +1,54 @@
+package promecieus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateTimeRange(t *testing.T) {
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	finished := started.Add(4 * time.Hour)
+	for _, tc := range []struct {
+		name             string
+		contents         archiveContents
+		expectedStarted  time.Time
+		expectedFinished time.Time
+	}{
+		{
+			name:             "fully read archive replaces markers",
+			contents:         archiveContents{Blocks: []blockMeta{testBlock(started.Add(time.Hour), started.Add(2*time.Hour), 100)}},
+			expectedStarted:  started.Add(time.Hour),
+			expectedFinished: started.Add(2 * time.Hour),
+		},
+		{
+			name:             "partially read archive keeps markers",
+			contents:         archiveContents{Partial: true, Blocks: []blockMeta{testBlock(started.Add(time.Hour), started.Add(2*time.Hour), 100)}},
+			expectedStarted:  started,
+			expectedFinished: finished,
+		},
+		{
+			name:             "partially read archive widens markers",
+			contents:         archiveContents{Partial: true, Blocks: []blockMeta{testBlock(started.Add(-time.Hour), started.Add(2*time.Hour), 100)}},
+			expectedStarted:  started.Add(-time.Hour),
+			expectedFinished: finished,
+		},
+		{
+			name: "WAL extends range till upload time",
+			contents: archiveContents{
+				Head:   archiveHead{LastModified: started.Add(3 * time.Hour)},
+				HasWAL: true,
+				Blocks: []blockMeta{testBlock(started.Add(time.Hour), started.Add(2*time.Hour), 100)},
+			},
+			expectedStarted:  started.Add(time.Hour),
+			expectedFinished: started.Add(3 * time.Hour),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prowInfo := &ProwInfo{Job: &ProwJob{}, MetricsURL: "https://example.com/" + promTarPath, Started: started, Finished: finished}
+			updateTimeRange(nil, prowInfo, map[string]*archiveContents{prowInfo.MetricsURL: &tc.contents})
+			if !prowInfo.Started.Equal(tc.expectedStarted) || !prowInfo.Finished.Equal(tc.expectedFinished) {
+				t.Errorf("expected range %s - %s, got %s - %s", tc.expectedStarted, tc.expectedFinished, prowInfo.Started, prowInfo.Finished)
+			}
+		})
+	}
+}
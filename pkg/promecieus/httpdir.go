@@ -0,0 +1,59 @@
+package promecieus
+
+import (
+	"context"
+	"net/url"
+	"strings"
+)
+
+// httpDirStore lists autoindex-style HTTP directories, like nginx autoindex or Apache mod_autoindex.
+// Bucket is the server URL and objects are paths on the server
+type httpDirStore struct {
+	fetcher *Fetcher
+}
+
+// locateHTTPDir handles http(s) links to directories, which end with a slash
+func locateHTTPDir(u *url.URL) (string, string, bool) {
+	if !isHTTPURL(u) || !strings.HasSuffix(u.Path, "/") {
+		return "", "", false
+	}
+	server := url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host}
+	return server.String(), strings.TrimPrefix(u.Path, "/"), true
+}
+
+func (h *httpDirStore) ObjectURL(bucket, name string) string {
+	return bucket + "/" + name
+}
+
+func (h *httpDirStore) List(ctx context.Context, bucket, prefix string) (*gcsListing, error) {
+	dirURL, err := url.Parse(h.ObjectURL(bucket, prefix))
+	if err != nil {
+		return nil, err
+	}
+	links, err := h.fetcher.getLinksFromURL(ctx, dirURL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	listing := &gcsListing{}
+	seen := map[string]bool{}
+	for _, link := range links {
+		linkURL, err := dirURL.Parse(link)
+		if err != nil || linkURL.Host != dirURL.Host {
+			continue
+		}
+		// Only direct children are listed, which skips parent folder and sorting links
+		name := strings.TrimPrefix(linkURL.Path, "/")
+		child := strings.TrimPrefix(name, prefix)
+		if !strings.HasPrefix(name, prefix) || child == "" || strings.Contains(strings.TrimSuffix(child, "/"), "/") || seen[name] {
+			continue
+		}
+		seen[name] = true
+		if strings.HasSuffix(name, "/") {
+			listing.Prefixes = append(listing.Prefixes, name)
+		} else {
+			listing.Objects = append(listing.Objects, gcsObject{Name: name})
+		}
+	}
+	return listing, nil
+}
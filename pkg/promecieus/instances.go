@@ -0,0 +1,264 @@
+package promecieus
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// archiveHashLabel is set on deployments to find instances of the same archives
+	archiveHashLabel = metadataAnnotationPrefix + "archive-hash"
+	// instanceURLAnnotation is the link sent to users, set once the instance is ready
+	instanceURLAnnotation = metadataAnnotationPrefix + "url"
+)
+
+// archiveHash identifies archives extracted into the instance. It's short enough to be a label value.
+// Presigned links change on every request, so only bucket and key are hashed
+func (p *ProwInfo) archiveHash() string {
+	urls := []string{}
+	for _, archive := range p.archives() {
+		id := redactPresigned(archive.URL)
+		if archive.Root != "" {
+			id += "#" + archive.Root
+		}
+		urls = append(urls, id)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(urls, "\n")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// instanceStream sends progress of an instance being created to every user who requested its archives.
+// Creation is not bound to any of the users and is cancelled once all of them have left
+type instanceStream struct {
+	sync.Mutex
+	appLabel string
+	conns    []*websocket.Conn
+	// labels are the ones users requested the instance with, they remove the instance by these
+	labels map[*websocket.Conn]string
+	// history is replayed to users attaching later
+	history []WSMessage
+	// readyMessage is set once the instance is ready
+	readyMessage *WSMessage
+	ctx          context.Context
+	cancel       context.CancelFunc
+	done         chan struct{}
+}
+
+func (i *instanceStream) send(action string, message string) {
+	i.sendWithData(action, message, nil)
+}
+
+func (i *instanceStream) sendWithData(action string, message string, data map[string]string) {
+	i.Lock()
+	defer i.Unlock()
+	i.history = append(i.history, WSMessage{Action: action, Message: message, Data: data})
+	for _, conn := range i.conns {
+		sendWSMessageWithData(conn, action, message, data)
+	}
+}
+
+// attach replays messages sent so far and forwards new ones to the user, label is the one the user requested the instance with.
+// Followers get the label of the instance first, so that the page could cancel it.
+// The final message is returned if the instance got ready before the user attached
+func (i *instanceStream) attach(conn *websocket.Conn, label string, announce bool) *WSMessage {
+	i.Lock()
+	defer i.Unlock()
+	if announce {
+		sendWSMessage(conn, "app-label", i.appLabel)
+	}
+	for _, m := range i.history {
+		sendWSMessageWithData(conn, m.Action, m.Message, m.Data)
+	}
+	if i.labels == nil {
+		i.labels = make(map[*websocket.Conn]string)
+	}
+	i.conns = append(i.conns, conn)
+	i.labels[conn] = label
+	return i.readyMessage
+}
+
+// ready sends the final message to every user following the instance. Each user gets their own label
+// to remove the instance by, which is recorded as a reference to the instance
+func (i *instanceStream) ready(refs *InstanceReferences, message string, instanceURL string) {
+	i.Lock()
+	defer i.Unlock()
+	i.readyMessage = &WSMessage{Action: "done", Message: message, Data: map[string]string{"url": instanceURL}}
+	for _, conn := range i.conns {
+		label := i.labels[conn]
+		refs.add(label, i.appLabel)
+		sendWSMessageWithData(conn, "done", message, map[string]string{"hash": label, "url": instanceURL})
+	}
+}
+
+// wait blocks until the instance is ready or failed. When the user leaves earlier, creation is
+// cancelled only if nobody else is waiting for it, and the last user gets the cleanup messages
+func (i *instanceStream) wait(ctx context.Context, conn *websocket.Conn) {
+	select {
+	case <-i.done:
+		return
+	case <-ctx.Done():
+	}
+
+	i.Lock()
+	if len(i.conns) == 1 && i.conns[0] == conn {
+		i.cancel()
+		i.Unlock()
+		<-i.done
+		return
+	}
+	if n := slices.Index(i.conns, conn); n >= 0 {
+		i.conns = slices.Delete(i.conns, n, n+1)
+	}
+	delete(i.labels, conn)
+	i.Unlock()
+	sendWSMessage(conn, "failure", fmt.Sprintf("Stopped following %s, it's still being created for other users", i.appLabel))
+}
+
+// InstanceStreams keeps streams of instances being created, keyed by archive hash
+type InstanceStreams struct {
+	sync.Mutex
+	list map[string]*instanceStream
+}
+
+// start returns a new stream for the instance, or the existing one if archives are already being deployed.
+// The second value is false in the latter case
+func (s *InstanceStreams) start(hash string, appLabel string) (*instanceStream, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if s.list == nil {
+		s.list = make(map[string]*instanceStream)
+	}
+	if stream, ok := s.list[hash]; ok {
+		return stream, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &instanceStream{
+		appLabel: appLabel,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	s.list[hash] = stream
+	return stream, true
+}
+
+// starting checks if an instance is being created for the archives
+func (s *InstanceStreams) starting(hash string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.list[hash]
+	return ok
+}
+
+// finish releases users following the instance
+func (s *InstanceStreams) finish(hash string, stream *instanceStream) {
+	s.Lock()
+	defer s.Unlock()
+	if s.list[hash] == stream {
+		delete(s.list, hash)
+	}
+	close(stream.done)
+	stream.cancel()
+}
+
+// InstanceReferences keeps users of ready instances. Every user removes the instance by their own label,
+// and the instance is deleted once the last user has removed it
+type InstanceReferences struct {
+	sync.Mutex
+	// list maps user labels to labels of the instances they use
+	list map[string]string
+}
+
+func (r *InstanceReferences) add(label string, appLabel string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.list == nil {
+		r.list = make(map[string]string)
+	}
+	r.list[label] = appLabel
+}
+
+// release drops the reference of the user and returns the label of the instance it used.
+// Unknown labels, i.e. of instances created before restart, are instance labels themselves.
+// The second value is true if other users still use the instance
+func (r *InstanceReferences) release(label string) (string, bool) {
+	r.Lock()
+	defer r.Unlock()
+	appLabel, ok := r.list[label]
+	if !ok {
+		return label, false
+	}
+	delete(r.list, label)
+	for _, other := range r.list {
+		if other == appLabel {
+			return appLabel, true
+		}
+	}
+	return appLabel, false
+}
+
+// findInstance returns label and link of a ready instance with the same archives
+func (s *ServerSettings) findInstance(ctx context.Context, hash string) (string, string, bool) {
+	listOpts := metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", archiveHashLabel, hash)}
+	depList, err := s.K8sClient.AppsV1().Deployments(s.Namespace).List(ctx, listOpts)
+	if err != nil {
+		klog.Warningf("Failed to find instances of archive %s: %v", hash, err)
+		return "", "", false
+	}
+	for _, dep := range depList.Items {
+		instanceURL, ok := dep.Annotations[instanceURLAnnotation]
+		if !ok || dep.DeletionTimestamp != nil || dep.Status.ReadyReplicas == 0 {
+			continue
+		}
+		return dep.Labels["app"], instanceURL, true
+	}
+	return "", "", false
+}
+
+// instanceAvailable checks if an instance for the archives is running or being created
+func (s *ServerSettings) instanceAvailable(ctx context.Context, p *ProwInfo) bool {
+	hash := p.archiveHash()
+	if s.Instances != nil && s.Instances.starting(hash) {
+		return true
+	}
+	if s.K8sClient == nil {
+		return false
+	}
+	_, _, ok := s.findInstance(ctx, hash)
+	return ok
+}
+
+// annotateInstanceURL records the link of a ready instance, so that it's sent to users requesting the same archives
+func (s *ServerSettings) annotateInstanceURL(ctx context.Context, appLabel string, instanceURL string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{instanceURLAnnotation: instanceURL},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	listOpts := metav1.ListOptions{LabelSelector: fmt.Sprintf("app=%s", appLabel)}
+	depList, err := s.K8sClient.AppsV1().Deployments(s.Namespace).List(ctx, listOpts)
+	if err != nil {
+		return fmt.Errorf("failed to find deployments: %v", err)
+	}
+	for _, dep := range depList.Items {
+		_, err := s.K8sClient.AppsV1().Deployments(s.Namespace).Patch(ctx, dep.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to annotate deployment %s: %v", dep.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package promecieus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	intervalsKind   = "intervals"
+	intervalsMetric = "promecieus_interval"
+)
+
+// intervalFilePrefixes are e2e timeline files in order of preference.
+// "everything" files include all the other timelines, so only one kind is used
+var intervalFilePrefixes = []string{"e2e-timelines_everything_", "e2e-intervals_everything_", "e2e-timelines_spyglass_"}
+
+func init() {
+	backfillConverters[intervalsKind] = convertIntervals
+}
+
+// e2eIntervals is the timeline written by openshift-tests
+type e2eIntervals struct {
+	Items []e2eInterval `json:"items"`
+}
+
+// e2eInterval has either structured or legacy string locator and message
+type e2eInterval struct {
+	Level   string          `json:"level"`
+	Source  string          `json:"source"`
+	Locator json.RawMessage `json:"locator"`
+	Message json.RawMessage `json:"message"`
+	From    time.Time       `json:"from"`
+	To      time.Time       `json:"to"`
+}
+
+type e2eLocator struct {
+	Type string            `json:"type"`
+	Keys map[string]string `json:"keys"`
+}
+
+type e2eMessage struct {
+	Reason string `json:"reason"`
+}
+
+// locator returns locator as a string, structured locator keys are sorted
+func (i *e2eInterval) locator() string {
+	var legacy string
+	if err := json.Unmarshal(i.Locator, &legacy); err == nil {
+		return legacy
+	}
+	var structured e2eLocator
+	if err := json.Unmarshal(i.Locator, &structured); err != nil {
+		return ""
+	}
+	keys := make([]string, 0, len(structured.Keys))
+	for key := range structured.Keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s/%s", key, structured.Keys[key]))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// reason is only set in structured messages
+func (i *e2eInterval) reason() string {
+	var message e2eMessage
+	if err := json.Unmarshal(i.Message, &message); err != nil {
+		return ""
+	}
+	return message.Reason
+}
+
+// findIntervalFiles picks e2e timelines from JUnit results folders, preferred kind is picked for each test
+func findIntervalFiles(bucket string, junitFiles []junitFile) []BackfillSource {
+	var tests []string
+	for _, obj := range junitFiles {
+		if !slices.Contains(tests, obj.test) {
+			tests = append(tests, obj.test)
+		}
+	}
+	var sources []BackfillSource
+	for _, test := range tests {
+		for _, prefix := range intervalFilePrefixes {
+			found := false
+			for _, obj := range junitFiles {
+				name := path.Base(obj.Name)
+				if obj.test == test && strings.HasPrefix(name, prefix) && path.Ext(name) == ".json" {
+					sources = append(sources, BackfillSource{Kind: intervalsKind, URL: gcsObjectURL(bucket, obj.Name), Test: obj.test, Step: obj.step})
+					found = true
+				}
+			}
+			if found {
+				break
+			}
+		}
+	}
+	return sources
+}
+
+// timeRange is a period when an interval series is set
+type timeRange struct {
+	from time.Time
+	to   time.Time
+}
+
+// convertIntervals turns each timeline interval into promecieus_interval series,
+// which is 1 while interval lasts and drops to 0 once it ends
+func convertIntervals(r io.Reader, w *openMetricsWriter) error {
+	var intervals e2eIntervals
+	if err := json.NewDecoder(r).Decode(&intervals); err != nil {
+		return fmt.Errorf("failed to unmarshal intervals: %v", err)
+	}
+	w.family(intervalsMetric, "gauge", "Interval from e2e timeline, 1 while the interval lasts")
+
+	// Overlapping intervals of the same series are merged, so that samples don't flip to 0 in between
+	ranges := map[string][]timeRange{}
+	labelSets := map[string]map[string]string{}
+	for _, interval := range intervals.Items {
+		if interval.From.IsZero() {
+			continue
+		}
+		to := interval.To
+		if to.Before(interval.From) {
+			to = interval.From
+		}
+		labels := map[string]string{
+			"source":  interval.Source,
+			"level":   interval.Level,
+			"locator": interval.locator(),
+			"reason":  interval.reason(),
+		}
+		key := formatLabels(labels)
+		labelSets[key] = labels
+		ranges[key] = append(ranges[key], timeRange{from: interval.From, to: to})
+	}
+
+	for key, seriesRanges := range ranges {
+		sort.Slice(seriesRanges, func(i, j int) bool {
+			return seriesRanges[i].from.Before(seriesRanges[j].from)
+		})
+		merged := []timeRange{seriesRanges[0]}
+		for _, tr := range seriesRanges[1:] {
+			last := &merged[len(merged)-1]
+			if !tr.from.After(last.to.Add(backfillStep)) {
+				if tr.to.After(last.to) {
+					last.to = tr.to
+				}
+				continue
+			}
+			merged = append(merged, tr)
+		}
+		for _, tr := range merged {
+			for t := tr.from; !t.After(tr.to); t = t.Add(backfillStep) {
+				w.add(intervalsMetric, labelSets[key], t, 1)
+			}
+			w.add(intervalsMetric, labelSets[key], tr.to, 1)
+			w.add(intervalsMetric, labelSets[key], tr.to.Add(time.Second), 0)
+		}
+	}
+	return nil
+}
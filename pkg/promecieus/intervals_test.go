@@ -0,0 +1,71 @@
+package promecieus
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConvertIntervals(t *testing.T) {
+	timeline := `{"items": [
+		{"level": "Warning", "source": "Disruption", "locator": "ns/foo", "message": "disrupted",
+		 "from": "2024-01-01T00:00:00Z", "to": "2024-01-01T00:00:45Z"},
+		{"level": "Warning", "source": "Disruption", "locator": "ns/foo", "message": "disrupted again",
+		 "from": "2024-01-01T00:01:00Z", "to": "2024-01-01T00:01:10Z"},
+		{"level": "Error", "source": "NodeMonitor",
+		 "locator": {"type": "Node", "keys": {"node": "n1", "namespace": "x"}},
+		 "message": {"reason": "NodeNotReady", "humanMessage": "not ready"},
+		 "from": "2024-01-01T00:10:00Z", "to": "2024-01-01T00:09:00Z"},
+		{"level": "Info", "source": "Unset", "locator": "ns/bar", "message": "no start"}
+	]}`
+	w := newOpenMetricsWriter()
+	if err := convertIntervals(strings.NewReader(timeline), w); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if _, err := w.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	// Intervals closer than backfill step are merged, interval ending before it starts is a point in time
+	expected := `# HELP promecieus_interval Interval from e2e timeline, 1 while the interval lasts
+# TYPE promecieus_interval gauge
+promecieus_interval{level="Error",locator="namespace/x node/n1",reason="NodeNotReady",source="NodeMonitor"} 1 1704067800.000
+promecieus_interval{level="Error",locator="namespace/x node/n1",reason="NodeNotReady",source="NodeMonitor"} 0 1704067801.000
+promecieus_interval{level="Warning",locator="ns/foo",source="Disruption"} 1 1704067200.000
+promecieus_interval{level="Warning",locator="ns/foo",source="Disruption"} 1 1704067230.000
+promecieus_interval{level="Warning",locator="ns/foo",source="Disruption"} 1 1704067260.000
+promecieus_interval{level="Warning",locator="ns/foo",source="Disruption"} 1 1704067270.000
+promecieus_interval{level="Warning",locator="ns/foo",source="Disruption"} 0 1704067271.000
+# EOF
+`
+	if b.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestConvertIntervalsInvalid(t *testing.T) {
+	if err := convertIntervals(strings.NewReader(`{"items": [`), newOpenMetricsWriter()); err == nil {
+		t.Error("expected truncated timeline to fail")
+	}
+}
+
+func TestFindIntervalFiles(t *testing.T) {
+	file := func(test, step, name string) junitFile {
+		return junitFile{gcsObject: gcsObject{Name: "logs/job/1/artifacts/" + test + "/" + step + "/artifacts/junit/" + name}, test: test, step: step}
+	}
+	files := []junitFile{
+		file("e2e", "openshift-e2e-test", "e2e-timelines_spyglass_20240101.json"),
+		file("e2e", "openshift-e2e-test", "e2e-timelines_everything_20240101.json"),
+		file("e2e", "openshift-e2e-test", "junit_e2e_20240101.xml"),
+		file("e2e-upgrade", "openshift-upgrade", "e2e-timelines_spyglass_20240101.json"),
+		file("e2e-upgrade", "openshift-upgrade", "e2e-timelines_spyglass_20240101.html"),
+	}
+	expected := []BackfillSource{
+		{Kind: intervalsKind, URL: gcsObjectURL("bucket", files[1].Name), Test: "e2e", Step: "openshift-e2e-test"},
+		{Kind: intervalsKind, URL: gcsObjectURL("bucket", files[3].Name), Test: "e2e-upgrade", Step: "openshift-upgrade"},
+	}
+	if sources := findIntervalFiles("bucket", files); !reflect.DeepEqual(sources, expected) {
+		t.Errorf("expected %+v, got %+v", expected, sources)
+	}
+}
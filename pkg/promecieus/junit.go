@@ -0,0 +1,370 @@
+package promecieus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	junitDir = "junit/"
+	// maxTestFailures limits the number of annotations posted for a single instance
+	maxTestFailures = 500
+	// maxAnnotationText is the length of failure message kept in the annotation
+	maxAnnotationText = 1024
+	annotationTag     = "promecieus"
+	// maxAnnotationRequests limits concurrent requests to grafana while posting annotations
+	maxAnnotationRequests = 8
+)
+
+// junitTimeFormats are timestamp formats used by JUnit reporters
+var junitTimeFormats = []string{time.RFC3339, "2006-01-02T15:04:05"}
+
+// TestFailure is a failed test case found in JUnit results
+type TestFailure struct {
+	// Test is the job test which results have the failure
+	Test    string    `json:"test,omitempty"`
+	Name    string    `json:"name"`
+	Suite   string    `json:"suite,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Started time.Time `json:"started"`
+	Ended   time.Time `json:"ended"`
+	// Flake is set when the test has passed on retry
+	Flake bool `json:"flake,omitempty"`
+}
+
+type junitTestCase struct {
+	Name      string  `xml:"name,attr"`
+	Time      float64 `xml:"time,attr"`
+	Timestamp string  `xml:"timestamp,attr"`
+	Failure   *struct {
+		Message string `xml:"message,attr"`
+		Text    string `xml:",chardata"`
+	} `xml:"failure"`
+	Skipped *struct{} `xml:"skipped"`
+}
+
+// parseJUnitTime returns zero time if timestamp is missing or has unknown format
+func parseJUnitTime(value string) time.Time {
+	for _, format := range junitTimeFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// junitFolder is a JUnit results folder of a job test, step is empty for results in the test folder
+type junitFolder struct {
+	prefix string
+	test   string
+	step   string
+}
+
+// junitFile is a file found in JUnit results folder
+type junitFile struct {
+	gcsObject
+	test string
+	step string
+}
+
+// readTestFailures streams JUnit XML and returns failed test cases and names of passed ones.
+// Cases without timestamps are placed before fallbackEnd, the time the results were written
+func readTestFailures(r io.Reader, fallbackEnd time.Time) ([]TestFailure, []string, error) {
+	decoder := xml.NewDecoder(r)
+	var (
+		suite          string
+		suiteTimestamp time.Time
+		failures       []TestFailure
+		passed         []string
+	)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return failures, passed, fmt.Errorf("failed to parse JUnit results: %v", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "testsuite":
+			suite, suiteTimestamp = "", time.Time{}
+			for _, attr := range start.Attr {
+				switch attr.Name.Local {
+				case "name":
+					suite = attr.Value
+				case "timestamp":
+					suiteTimestamp = parseJUnitTime(attr.Value)
+				}
+			}
+		case "testcase":
+			var tc junitTestCase
+			if err := decoder.DecodeElement(&tc, &start); err != nil {
+				return failures, passed, fmt.Errorf("failed to parse test case: %v", err)
+			}
+			if tc.Failure == nil {
+				if tc.Skipped == nil {
+					passed = append(passed, tc.Name)
+				}
+				continue
+			}
+			duration := time.Duration(tc.Time * float64(time.Second))
+			started := parseJUnitTime(tc.Timestamp)
+			if started.IsZero() {
+				started = suiteTimestamp
+			}
+			if started.IsZero() {
+				started = fallbackEnd.Add(-duration)
+			}
+			message := tc.Failure.Message
+			if message == "" {
+				message = strings.TrimSpace(tc.Failure.Text)
+			}
+			if len(message) > maxAnnotationText {
+				message = message[:maxAnnotationText] + "..."
+			}
+			failures = append(failures, TestFailure{
+				Name:    tc.Name,
+				Suite:   suite,
+				Message: message,
+				Started: started,
+				Ended:   started.Add(duration),
+			})
+		}
+	}
+	return failures, passed, nil
+}
+
+// listJUnitFolders returns all files of JUnit results folders
+func (p *prowResolver) listJUnitFolders(ctx context.Context, bucket string, folders []junitFolder) []junitFile {
+	var files []junitFile
+	for _, folder := range folders {
+		listing, err := p.lister.List(ctx, bucket, folder.prefix)
+		if err != nil {
+			klog.Infof("failed to list %s: %v", folder.prefix, err)
+			continue
+		}
+		for _, obj := range listing.Objects {
+			files = append(files, junitFile{gcsObject: obj, test: folder.test, step: folder.step})
+		}
+	}
+	return files
+}
+
+// findTestFailures reads JUnit XML files of all job tests. Failures are informational,
+// so unreadable files are skipped
+func (p *prowResolver) findTestFailures(ctx context.Context, bucket string, junitFiles []junitFile, fallbackEnd time.Time) []TestFailure {
+	var files []junitFile
+	for _, obj := range junitFiles {
+		if path.Ext(obj.Name) == ".xml" {
+			files = append(files, obj)
+		}
+	}
+
+	found := make([][]TestFailure, len(files))
+	passed := make([][]string, len(files))
+	var wg sync.WaitGroup
+	for i, obj := range files {
+		wg.Add(1)
+		go func(i int, obj junitFile) {
+			defer wg.Done()
+			end := obj.Updated
+			if end.IsZero() {
+				end = fallbackEnd
+			}
+			fileURL := gcsObjectURL(bucket, obj.Name)
+			resp, err := p.fetcher.Get(ctx, fileURL)
+			if err != nil {
+				klog.Infof("failed to fetch %s: %v", fileURL, err)
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				klog.Infof("failed to fetch %s: returned %s", fileURL, resp.Status)
+				return
+			}
+			if found[i], passed[i], err = readTestFailures(resp.Body, end); err != nil {
+				klog.Infof("failed to read %s: %v", fileURL, err)
+			}
+			for j := range found[i] {
+				found[i][j].Test = obj.test
+			}
+		}(i, obj)
+	}
+	wg.Wait()
+	return mergeTestFailures(found, passed)
+}
+
+// mergeTestFailures sorts failures of all files by time. Retried tests may be reported
+// in another file, so those which passed eventually are marked across all files of the job
+func mergeTestFailures(found [][]TestFailure, passed [][]string) []TestFailure {
+	passedNames := map[string]bool{}
+	for _, names := range passed {
+		for _, name := range names {
+			passedNames[name] = true
+		}
+	}
+	var failures []TestFailure
+	for _, f := range found {
+		failures = append(failures, f...)
+	}
+	for i := range failures {
+		failures[i].Flake = passedNames[failures[i].Name]
+	}
+	sort.SliceStable(failures, func(i, j int) bool {
+		return failures[i].Started.Before(failures[j].Started)
+	})
+	return failures
+}
+
+// testFailures returns failures of the job test, annotations are limited to the first maxTestFailures
+func testFailures(failures []TestFailure, test string) []TestFailure {
+	var scoped []TestFailure
+	for _, failure := range failures {
+		if failure.Test != test {
+			continue
+		}
+		if len(scoped) == maxTestFailures {
+			klog.Infof("Found more than %d failures of %s, keeping first %d", maxTestFailures, test, maxTestFailures)
+			break
+		}
+		scoped = append(scoped, failure)
+	}
+	return scoped
+}
+
+// GrafanaAnnotation is a region annotation posted to grafana
+type GrafanaAnnotation struct {
+	Time    int64    `json:"time"`
+	TimeEnd int64    `json:"timeEnd"`
+	Tags    []string `json:"tags"`
+	Text    string   `json:"text"`
+}
+
+// GrafanaAnnotationResponse represents response from grafana
+type GrafanaAnnotationResponse struct {
+	ID int `json:"id"`
+}
+
+// addTestAnnotations posts failures as annotations tagged with the datasource name and returns IDs of those posted.
+// Annotations are posted concurrently, limited by maxAnnotationRequests
+func (s *ServerSettings) addTestAnnotations(dsName string, failures []TestFailure) ([]int, error) {
+	var (
+		lock     sync.Mutex
+		wg       sync.WaitGroup
+		ids      []int
+		firstErr error
+	)
+	slots := make(chan struct{}, maxAnnotationRequests)
+	for _, failure := range failures {
+		kind := "failure"
+		if failure.Flake {
+			kind = "flake"
+		}
+		text := fmt.Sprintf("%s %s", kind, failure.Name)
+		if failure.Message != "" {
+			text = fmt.Sprintf("%s: %s", text, failure.Message)
+		}
+		annotation := &GrafanaAnnotation{
+			Time:    failure.Started.UnixMilli(),
+			TimeEnd: failure.Ended.UnixMilli(),
+			Tags:    []string{annotationTag, dsName, kind},
+			Text:    text,
+		}
+
+		slots <- struct{}{}
+		// Stop posting once grafana has refused an annotation
+		lock.Lock()
+		failed := firstErr != nil
+		lock.Unlock()
+		if failed {
+			<-slots
+			break
+		}
+		wg.Add(1)
+		go func(annotation *GrafanaAnnotation) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			id, err := s.addAnnotation(annotation)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			ids = append(ids, id)
+		}(annotation)
+	}
+	wg.Wait()
+	return ids, firstErr
+}
+
+func (s *ServerSettings) addAnnotation(annotation *GrafanaAnnotation) (int, error) {
+	data, err := json.Marshal(annotation)
+	if err != nil {
+		return 0, err
+	}
+	var netClient = &http.Client{
+		Timeout: time.Second * 10,
+	}
+	apiURL := fmt.Sprintf("%s/api/annotations", s.Grafana.URL)
+	req, err := s.grafanaRequest("POST", apiURL, bytes.NewBuffer(data))
+	if err != nil {
+		return 0, fmt.Errorf("failed to construct POST request to %s: %v", apiURL, err)
+	}
+	resp, err := netClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to perform request %s: %v", apiURL, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to add annotation: %s returned %s: %s", apiURL, resp.Status, body)
+	}
+	annotationResponse := &GrafanaAnnotationResponse{}
+	if err := json.Unmarshal(body, annotationResponse); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal response %s : %v", body, err)
+	}
+	return annotationResponse.ID, nil
+}
+
+func (s *ServerSettings) removeAnnotation(id int) error {
+	var netClient = &http.Client{
+		Timeout: time.Second * 10,
+	}
+	apiURL := fmt.Sprintf("%s/api/annotations/%d", s.Grafana.URL, id)
+	req, err := s.grafanaRequest("DELETE", apiURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to construct DELETE request to %s: %v", apiURL, err)
+	}
+	resp, err := netClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to perform request %s: %v", apiURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to remove annotation %d: %s returned %s", id, apiURL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package promecieus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadTestFailures(t *testing.T) {
+	fallbackEnd := time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)
+	results := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="openshift-tests" timestamp="2024-01-01T01:00:00">
+    <testcase name="passed test" time="10"></testcase>
+    <testcase name="skipped test" time="0"><skipped message="not supported"></skipped></testcase>
+    <testcase name="timestamped failure" time="30" timestamp="2024-01-01T01:10:00Z">
+      <failure message="timed out">stack</failure>
+    </testcase>
+    <testcase name="suite failure" time="60"><failure>  details  </failure></testcase>
+  </testsuite>
+  <testsuite name="untimed">
+    <testcase name="untimed failure" time="120"><failure message="` + strings.Repeat("x", maxAnnotationText+1) + `"></failure></testcase>
+  </testsuite>
+</testsuites>`
+
+	failures, passed, err := readTestFailures(strings.NewReader(results), fallbackEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(passed, []string{"passed test"}) {
+		t.Errorf("expected only passed test to be reported, got %q", passed)
+	}
+	suiteStart := time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)
+	expected := []TestFailure{
+		{
+			Name:    "timestamped failure",
+			Suite:   "openshift-tests",
+			Message: "timed out",
+			Started: time.Date(2024, 1, 1, 1, 10, 0, 0, time.UTC),
+			Ended:   time.Date(2024, 1, 1, 1, 10, 30, 0, time.UTC),
+		},
+		{
+			Name:    "suite failure",
+			Suite:   "openshift-tests",
+			Message: "details",
+			Started: suiteStart,
+			Ended:   suiteStart.Add(time.Minute),
+		},
+		{
+			Name:    "untimed failure",
+			Suite:   "untimed",
+			Message: strings.Repeat("x", maxAnnotationText) + "...",
+			Started: fallbackEnd.Add(-2 * time.Minute),
+			Ended:   fallbackEnd,
+		},
+	}
+	if !reflect.DeepEqual(failures, expected) {
+		t.Errorf("expected %+v, got %+v", expected, failures)
+	}
+}
+
+func TestReadTestFailuresInvalidXML(t *testing.T) {
+	failures, _, err := readTestFailures(strings.NewReader(`<testsuite><testcase name="a"><failure/></testcase><testcase`), time.Now())
+	if err == nil {
+		t.Fatal("expected truncated results to fail")
+	}
+	if len(failures) != 1 {
+		t.Errorf("expected failures read before the error to be kept, got %+v", failures)
+	}
+}
+
+func TestMergeTestFailuresFlakesAcrossFiles(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	found := [][]TestFailure{
+		{{Test: "e2e", Name: "retried", Started: start.Add(time.Minute)}},
+		{{Test: "e2e", Name: "failed", Started: start}},
+	}
+	// Retry result is written into another file
+	passed := [][]string{nil, {"retried"}}
+
+	failures := mergeTestFailures(found, passed)
+	expected := []TestFailure{
+		{Test: "e2e", Name: "failed", Started: start},
+		{Test: "e2e", Name: "retried", Started: start.Add(time.Minute), Flake: true},
+	}
+	if !reflect.DeepEqual(failures, expected) {
+		t.Errorf("expected %+v, got %+v", expected, failures)
+	}
+}
+
+func TestUseCandidateScopesFailures(t *testing.T) {
+	failures := []TestFailure{
+		{Test: "e2e-aws", Name: "a"},
+		{Test: "e2e-upgrade", Name: "b"},
+	}
+	for i := 0; i < maxTestFailures+1; i++ {
+		failures = append(failures, TestFailure{Test: "e2e-many", Name: fmt.Sprintf("test %d", i)})
+	}
+	prowInfo := &ProwInfo{artifacts: &jobArtifacts{failures: failures}}
+
+	prowInfo.useCandidate(MetricsCandidate{Test: "e2e-upgrade", Step: extraPath})
+	if !reflect.DeepEqual(prowInfo.Failures, []TestFailure{{Test: "e2e-upgrade", Name: "b"}}) {
+		t.Errorf("expected failures of the selected test only, got %+v", prowInfo.Failures)
+	}
+	prowInfo.useCandidate(MetricsCandidate{Test: "e2e-many", Step: extraPath})
+	if len(prowInfo.Failures) != maxTestFailures {
+		t.Errorf("expected %d failures to be kept, got %d", maxTestFailures, len(prowInfo.Failures))
+	}
+	prowInfo.useCandidate(MetricsCandidate{Test: "e2e-none", Step: extraPath})
+	if len(prowInfo.Failures) != 0 {
+		t.Errorf("expected no failures for test without results, got %+v", prowInfo.Failures)
+	}
+}
+
+func TestAddTestAnnotationsConcurrently(t *testing.T) {
+	var (
+		inFlight, maxInFlight, lastID atomic.Int32
+		lock                          sync.Mutex
+		texts                         []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			seen := maxInFlight.Load()
+			if current <= seen || maxInFlight.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+		var annotation GrafanaAnnotation
+		if err := json.NewDecoder(r.Body).Decode(&annotation); err != nil {
+			t.Error(err)
+		}
+		lock.Lock()
+		texts = append(texts, annotation.Text)
+		lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprintf(w, `{"id": %d}`, lastID.Add(1))
+	}))
+	defer server.Close()
+	s := &ServerSettings{Grafana: &GrafanaSettings{URL: server.URL}}
+
+	var failures []TestFailure
+	for i := 0; i < 3*maxAnnotationRequests; i++ {
+		failures = append(failures, TestFailure{Name: fmt.Sprintf("test %d", i), Flake: i == 0})
+	}
+	ids, err := s.addTestAnnotations("abcde", failures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(failures) {
+		t.Errorf("expected %d annotation IDs, got %d", len(failures), len(ids))
+	}
+	if maxInFlight.Load() > maxAnnotationRequests {
+		t.Errorf("expected at most %d concurrent requests, got %d", maxAnnotationRequests, maxInFlight.Load())
+	}
+	sort.Strings(texts)
+	if texts[0] != "failure test 1" || !slices.Contains(texts, "flake test 0") {
+		t.Errorf("unexpected annotation texts %q", texts)
+	}
+}
+
+func TestAddTestAnnotationsFailure(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > 2 {
+			http.Error(w, "grafana is down", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"id": 1}`)
+	}))
+	defer server.Close()
+	s := &ServerSettings{Grafana: &GrafanaSettings{URL: server.URL}}
+
+	failures := make([]TestFailure, maxTestFailures)
+	ids, err := s.addTestAnnotations("abcde", failures)
+	if err == nil {
+		t.Fatal("expected grafana error to be returned")
+	}
+	if len(ids) != 2 {
+		t.Errorf("expected IDs of posted annotations to be kept, got %v", ids)
+	}
+	if int(requests.Load()) > 2+2*maxAnnotationRequests {
+		t.Errorf("expected posting to stop after the error, got %d requests", requests.Load())
+	}
+}
@@ -11,16 +11,12 @@ import (
 	"strings"
 	"time"
 
-	"github.com/gorilla/websocket"
-	routeApi "github.com/openshift/api/route/v1"
 	routeClient "github.com/openshift/client-go/route/clientset/versioned/typed/route/v1"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/watch"
 	k8s "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -76,164 +72,86 @@ func TryLogin(kubeconfigPath string) (*k8s.Clientset, *routeClient.RouteV1Client
 
 }
 
-func (s *ServerSettings) launchPromApp(ctx context.Context, appLabel string, metricsTar string) (string, error) {
-	replicas := int32(1)
-	sharePIDNamespace := true
-
-	// Declare and create new deployment
-	deployment := &appsv1.Deployment{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: fmt.Sprintf(promAppLabel, appLabel),
-			Labels: map[string]string{
-				"app": appLabel,
-			},
-		},
-		Spec: appsv1.DeploymentSpec{
-			Replicas: &replicas,
-			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"app": appLabel,
-				},
-			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app": appLabel,
-					},
-				},
-				Spec: corev1.PodSpec{
-					InitContainers: []corev1.Container{
-						{
-							Name:  promInitContainerName,
-							Image: ciFetcherImage,
-							Command: []string{
-								"/bin/bash",
-								"-c",
-								"set -uxo pipefail && umask 0000 && curl -sL ${PROMTAR} | tar xvz --exclude=. -m --no-overwrite-dir",
-							},
-							WorkingDir: "/prometheus/",
-							Env: []corev1.EnvVar{
-								{
-									Name:  "PROMTAR",
-									Value: metricsTar,
-								},
-							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "prometheus-storage-volume",
-									MountPath: "/prometheus/",
-								},
-							},
-						},
-					},
-					Containers: []corev1.Container{
-						{
-							Name:  promContainerName,
-							Image: prometheusImage,
-							Ports: []corev1.ContainerPort{
-								{
-									Name:          "webui",
-									Protocol:      corev1.ProtocolTCP,
-									ContainerPort: 9090,
-								},
-							},
-							ReadinessProbe: &corev1.Probe{
-								TimeoutSeconds:   1,
-								PeriodSeconds:    10,
-								SuccessThreshold: 1,
-								FailureThreshold: 3,
-								ProbeHandler: corev1.ProbeHandler{
-									HTTPGet: &corev1.HTTPGetAction{
-										Path:   "/",
-										Port:   intstr.FromInt(9090),
-										Scheme: "HTTP",
-									},
-								},
-							},
-							Resources: corev1.ResourceRequirements{
-								Requests: corev1.ResourceList{
-									"cpu":    resource.MustParse("100m"),
-									"memory": resource.MustParse("500Mi"),
-								},
-							},
-							VolumeMounts: []corev1.VolumeMount{
-								{
-									Name:      "prometheus-storage-volume",
-									MountPath: "/prometheus/",
-								},
-							},
-						},
-					},
-					ShareProcessNamespace: &sharePIDNamespace,
-					Volumes: []corev1.Volume{
-						{
-							Name: "prometheus-storage-volume",
-							VolumeSource: corev1.VolumeSource{
-								EmptyDir: &corev1.EmptyDirVolumeSource{},
-							},
-						},
-					},
-				},
-			},
-		},
+// fetchScript builds init container script which extracts all archives into prometheus storage
+func fetchScript(archives []MetricsArchive) (string, []corev1.EnvVar) {
+	commands := []string{"set -uxo pipefail", "umask 0000"}
+	env := []corev1.EnvVar{}
+	for i, archive := range archives {
+		envName := "PROMTAR"
+		if i > 0 {
+			envName = fmt.Sprintf("PROMTAR_%d", i+1)
+		}
+		env = append(env, corev1.EnvVar{
+			Name:  envName,
+			Value: archive.fetchURL(),
+		})
+		options := "--exclude=."
+		members := ""
+		if archive.Root != "" {
+			// Only the data directory is extracted, with its parent directories stripped
+			rootEnvName := envName + "_ROOT"
+			env = append(env, corev1.EnvVar{
+				Name:  rootEnvName,
+				Value: archive.Root,
+			})
+			options += fmt.Sprintf(" --strip-components=%d", len(strings.Split(archive.Root, "/")))
+			members = fmt.Sprintf(" \"${%s}\"", rootEnvName)
+		}
+		commands = append(commands, fmt.Sprintf("curl -sL ${%s} | tar %s %s -m --no-overwrite-dir%s", envName, archive.Format.tarFlags(), options, members))
 	}
-	_, err := s.K8sClient.AppsV1().Deployments(s.Namespace).Create(ctx, deployment, metav1.CreateOptions{})
+	return strings.Join(commands, " && "), env
+}
+
+func (s *ServerSettings) launchPromApp(ctx context.Context, appLabel string, prowInfo ProwInfo) (string, error) {
+	script, scriptEnv := fetchScript(prowInfo.archives())
+	if backfillCommands, backfillEnv := backfillFetchCommands(prowInfo.BackfillURLs); len(backfillCommands) > 0 {
+		script = strings.Join(append([]string{script}, backfillCommands...), " && ")
+		scriptEnv = append(scriptEnv, backfillEnv...)
+	}
+	params := manifestParams{
+		AppLabel:        appLabel,
+		Name:            fmt.Sprintf(promAppLabel, appLabel),
+		Namespace:       s.Namespace,
+		Cluster:         prowInfo.Cluster,
+		MetricsURL:      prowInfo.MetricsURL,
+		Started:         prowInfo.Started,
+		Finished:        prowInfo.Finished,
+		PrometheusImage: prometheusImage,
+		FetcherImage:    ciFetcherImage,
+		FetchScript:     script,
+		FetchEnv:        scriptEnv,
+	}
+	if len(prowInfo.BackfillURLs) > 0 {
+		params.BackfillScript = backfillScript()
+	}
+	if prowInfo.Metadata != nil {
+		params.Annotations = prowInfo.Metadata.annotations()
+	}
+	if prowInfo.Sizing != nil {
+		params.Resources = prowInfo.Sizing.Resources
+		params.EmptyDir = prowInfo.Sizing.emptyDir()
+	}
+	if err := s.Exposer.Configure(&params); err != nil {
+		return "", err
+	}
+	manifests, err := s.Templates.render(s.Exposer.Template(), params)
 	if err != nil {
-		return "", fmt.Errorf("failed to create new deployment: %s", err.Error())
+		return "", err
 	}
+	// Requests for the same archives are attached to this instance, see findInstance
+	manifests.deployment.Labels[archiveHashLabel] = prowInfo.archiveHash()
 
-	service := &corev1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: appLabel,
-			Labels: map[string]string{
-				"app": appLabel,
-			},
-		},
-		Spec: corev1.ServiceSpec{
-			Ports: []corev1.ServicePort{
-				{
-					Port:     9090,
-					Protocol: corev1.ProtocolTCP,
-					Name:     "webui",
-				},
-			},
-			Selector: map[string]string{
-				"app": appLabel,
-			},
-		},
-	}
-	_, err = s.K8sClient.CoreV1().Services(s.Namespace).Create(ctx, service, metav1.CreateOptions{})
+	_, err = s.K8sClient.AppsV1().Deployments(s.Namespace).Create(ctx, manifests.deployment, metav1.CreateOptions{})
 	if err != nil {
-		return "", fmt.Errorf("failed to create new service: %s", err.Error())
+		return "", fmt.Errorf("failed to create new deployment: %s", err.Error())
 	}
 
-	promRoute := &routeApi.Route{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: appLabel,
-			Labels: map[string]string{
-				"app": appLabel,
-			},
-		},
-		Spec: routeApi.RouteSpec{
-			To: routeApi.RouteTargetReference{
-				Kind: "Service",
-				Name: appLabel,
-			},
-			Port: &routeApi.RoutePort{
-				TargetPort: intstr.FromInt(9090),
-			},
-			TLS: &routeApi.TLSConfig{
-				Termination:                   routeApi.TLSTerminationEdge,
-				InsecureEdgeTerminationPolicy: routeApi.InsecureEdgeTerminationPolicyRedirect,
-			},
-		},
-	}
-	route, err := s.RouteClient.Routes(s.Namespace).Create(ctx, promRoute, metav1.CreateOptions{})
+	_, err = s.K8sClient.CoreV1().Services(s.Namespace).Create(ctx, manifests.service, metav1.CreateOptions{})
 	if err != nil {
-		return "", fmt.Errorf("failed to create route: %v", err)
+		return "", fmt.Errorf("failed to create new service: %s", err.Error())
 	}
 
-	return fmt.Sprintf("https://%s", route.Spec.Host), nil
+	return s.Exposer.Create(ctx, appLabel, manifests.exposure)
 }
 
 func (s *ServerSettings) waitForEndpointReady(ctx context.Context, promRoute string) error {
@@ -250,11 +168,16 @@ func (s *ServerSettings) waitForEndpointReady(ctx context.Context, promRoute str
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-timer.C:
-			response, err := client.Get(promRoute + "/-/ready")
+			req, err := http.NewRequestWithContext(ctx, "GET", promRoute+"/-/ready", nil)
+			if err != nil {
+				return err
+			}
+			response, err := client.Do(req)
 			if err != nil {
 				klog.Infof("getting [%v] resulted in err [%v], retrying...", promRoute, err)
 				continue
 			}
+			response.Body.Close()
 			if response.StatusCode != 200 {
 				klog.Infof("getting [%v] returned non-OK status code [%v], retrying...", promRoute, response.StatusCode)
 			} else {
@@ -265,7 +188,7 @@ func (s *ServerSettings) waitForEndpointReady(ctx context.Context, promRoute str
 	}
 }
 
-func (s *ServerSettings) waitForDeploymentReady(ctx context.Context, appLabel string, conn *websocket.Conn) error {
+func (s *ServerSettings) waitForDeploymentReady(ctx context.Context, appLabel string, stream *instanceStream) error {
 	deploymentName := fmt.Sprintf(promAppLabel, appLabel)
 	klog.Infof("waiting for deployment %s to create pods", deploymentName)
 	timeLimitedCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
@@ -343,8 +266,8 @@ func (s *ServerSettings) waitForDeploymentReady(ctx context.Context, appLabel st
 			n, err := podLogs.Read(buf)
 			if n > 0 {
 				logLine := strings.TrimSpace(string(buf[:n]))
-				if logLine != "" && conn != nil {
-					sendWSMessage(conn, "log", logLine)
+				if logLine != "" && stream != nil {
+					stream.send("log", logLine)
 				}
 			}
 			if err != nil {
@@ -448,18 +371,11 @@ func (s *ServerSettings) deletePods(ctx context.Context, appLabel string) (strin
 		actionLog = append(actionLog, fmt.Sprintf("Removed config map %s", cm.Name))
 	}
 
-	// Delete route
-	routeList, err := s.RouteClient.Routes(s.Namespace).List(ctx, listOpts)
-	if err != nil || routeList.Items == nil {
-		return "", fmt.Errorf("failed to find routes: %v", err)
-	}
-	for _, route := range routeList.Items {
-		err := s.RouteClient.Routes(s.Namespace).Delete(ctx, route.Name, metav1.DeleteOptions{})
-		if err != nil {
-			return strings.Join(actionLog, "\n"),
-				fmt.Errorf("error removing route %s: %v", route.Name, err)
-		}
-		actionLog = append(actionLog, fmt.Sprintf("Removed route %s", route.Name))
+	// Delete route, ingress or HTTPRoute
+	removed, err := s.Exposer.Remove(ctx, appLabel)
+	actionLog = append(actionLog, removed...)
+	if err != nil {
+		return strings.Join(actionLog, "\n"), err
 	}
 
 	return strings.Join(actionLog, "\n"), nil
@@ -483,8 +399,12 @@ func (s *ServerSettings) CleanupOldDeployements(ctx context.Context) {
 			// Deployment has no app label
 			continue
 		}
-		createdAt := dep.GetCreationTimestamp()
-		if now.After(createdAt.Add(deploymentLifetime)) {
+		lastUsed := dep.GetCreationTimestamp().Time
+		// Instances still used via proxy are kept
+		if proxy, ok := s.Exposer.(*proxyExposer); ok && proxy.LastAccess(appLabel).After(lastUsed) {
+			lastUsed = proxy.LastAccess(appLabel)
+		}
+		if now.After(lastUsed.Add(deploymentLifetime)) {
 			klog.Infof("Deployment will be garbage collected")
 			go s.deletePods(ctx, appLabel)
 		} else {
@@ -499,14 +419,20 @@ func (s *ServerSettings) GetResourceQuota(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to get ResourceQuota: %v", err)
 	}
-	s.RQStatus = &RQuotaStatus{
-		Used: rquota.Status.Used.Pods().Value(),
-		Hard: rquota.Status.Hard.Pods().Value(),
-	}
+	s.RQStatus = quotaStatus(rquota)
 	s.sendResourceQuotaUpdate()
 	return nil
 }
 
+// quotaStatus returns pods usage and all limits of the quota
+func quotaStatus(rquota *corev1.ResourceQuota) *RQuotaStatus {
+	return &RQuotaStatus{
+		Used:          rquota.Status.Used.Pods().Value(),
+		Hard:          rquota.Status.Hard.Pods().Value(),
+		HardResources: rquota.Status.Hard,
+	}
+}
+
 // WatchResourceQuota passes RQ updates from k8s to UI
 func (s *ServerSettings) WatchResourceQuota(ctx context.Context) {
 	watchtools.UntilWithSync(ctx,
@@ -516,10 +442,7 @@ func (s *ServerSettings) WatchResourceQuota(ctx context.Context) {
 		nil,
 		func(event watch.Event) (bool, error) {
 			rquota := event.Object.(*corev1.ResourceQuota)
-			s.RQStatus = &RQuotaStatus{
-				Used: rquota.Status.Used.Pods().Value(),
-				Hard: rquota.Status.Hard.Pods().Value(),
-			}
+			s.RQStatus = quotaStatus(rquota)
 			klog.Infof("ResourceQuota update: %v", s.RQStatus)
 			s.sendResourceQuotaUpdate()
 			return true, nil
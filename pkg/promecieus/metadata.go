@@ -0,0 +1,267 @@
+package promecieus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	metadataAnnotationPrefix = "promecieus.openshift.io/"
+	cloudLabel               = "ci-operator.openshift.io/cloud"
+	clusterProfileLabel      = "ci-operator.openshift.io/cloud-cluster-profile"
+	jobVersionKey            = "job-version"
+	clusterVersionFile       = "clusterversion.json"
+	jobMetricsFile           = "job_metrics.json"
+	// maxJobMetrics caps job metrics kept, so that they fit into annotations
+	maxJobMetrics = 100
+	// unknownPayloadVersion is shown when finished.json has no payload version
+	unknownPayloadVersion = "unknown"
+)
+
+// JobMetadata describes the job run the metrics were collected in
+type JobMetadata struct {
+	Job            string   `json:"job"`
+	Type           string   `json:"type"`
+	State          string   `json:"state,omitempty"`
+	URL            string   `json:"url,omitempty"`
+	Refs           []string `json:"refs,omitempty"`
+	ClusterProfile string   `json:"clusterProfile,omitempty"`
+	Platform       string   `json:"platform,omitempty"`
+	PayloadVersion string   `json:"payloadVersion,omitempty"`
+	// PayloadVersionUnknown explains why payload version is not set
+	PayloadVersionUnknown string `json:"payloadVersionUnknown,omitempty"`
+	// ClusterVersions is the version history of the tested cluster, oldest first
+	ClusterVersions []string `json:"clusterVersions,omitempty"`
+	// JobMetrics are values gather-extra step queried in the selected test, keyed by metric and labels
+	JobMetrics map[string]string `json:"jobMetrics,omitempty"`
+}
+
+// prowJobRefs are repos tested by the job
+type prowJobRefs struct {
+	Org     string `json:"org"`
+	Repo    string `json:"repo"`
+	BaseRef string `json:"base_ref"`
+	Pulls   []struct {
+		Number int    `json:"number"`
+		SHA    string `json:"sha"`
+	} `json:"pulls"`
+}
+
+// String formats refs as org/repo@branch followed by PR numbers
+func (r prowJobRefs) String() string {
+	ref := fmt.Sprintf("%s/%s@%s", r.Org, r.Repo, r.BaseRef)
+	for _, pull := range r.Pulls {
+		ref += fmt.Sprintf(" #%d", pull.Number)
+	}
+	return ref
+}
+
+// prowJobJSON is the part of prowjob.json we're interested in
+type prowJobJSON struct {
+	Metadata struct {
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		Job       string        `json:"job"`
+		Type      string        `json:"type"`
+		Refs      *prowJobRefs  `json:"refs"`
+		ExtraRefs []prowJobRefs `json:"extra_refs"`
+	} `json:"spec"`
+	Status struct {
+		State string `json:"state"`
+		URL   string `json:"url"`
+	} `json:"status"`
+}
+
+// finishedJSON is finished.json with metadata set by ci-operator
+type finishedJSON struct {
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+// clusterVersionJSON is ClusterVersion list collected by gather-extra step
+type clusterVersionJSON struct {
+	Items []struct {
+		Status struct {
+			History []struct {
+				Version string `json:"version"`
+				State   string `json:"state"`
+			} `json:"history"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// jobMetricsJSON is job_metrics.json collected by gather-extra step: prometheus query results by metric name
+type jobMetricsJSON map[string]struct {
+	Data struct {
+		Result []struct {
+			Metric map[string]string `json:"metric"`
+			Value  []interface{}     `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// getJSON fetches and unmarshals a JSON document
+func (f *Fetcher) getJSON(ctx context.Context, rawURL string, v interface{}) error {
+	resp, err := f.Get(ctx, rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch %s: returned %s", rawURL, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %v", rawURL, err)
+	}
+	return nil
+}
+
+// fetchJobMetadata reads job details from prowjob.json and payload version from finished.json
+func (f *Fetcher) fetchJobMetadata(ctx context.Context, job *ProwJob) (*JobMetadata, error) {
+	jobPath := job.Path()
+	var prowJob prowJobJSON
+	if err := f.getJSON(ctx, gcsObjectURL(job.Bucket, jobPath+"prowjob.json"), &prowJob); err != nil {
+		return nil, err
+	}
+	metadata := &JobMetadata{
+		Job:            prowJob.Spec.Job,
+		Type:           prowJob.Spec.Type,
+		State:          prowJob.Status.State,
+		URL:            prowJob.Status.URL,
+		Refs:           []string{},
+		ClusterProfile: prowJob.Metadata.Labels[clusterProfileLabel],
+		Platform:       prowJob.Metadata.Labels[cloudLabel],
+	}
+	if prowJob.Spec.Refs != nil {
+		metadata.Refs = append(metadata.Refs, prowJob.Spec.Refs.String())
+	}
+	for _, refs := range prowJob.Spec.ExtraRefs {
+		metadata.Refs = append(metadata.Refs, refs.String())
+	}
+
+	// Version of the tested payload is known once the job has finished
+	var finished finishedJSON
+	if err := f.getJSON(ctx, gcsObjectURL(job.Bucket, jobPath+"finished.json"), &finished); err != nil {
+		klog.Infof("failed to read payload version of %s: %v", job.Name, err)
+		metadata.PayloadVersionUnknown = "finished.json is missing or unreadable"
+	} else if version, ok := finished.Metadata[jobVersionKey].(string); ok && version != "" {
+		metadata.PayloadVersion = version
+	} else {
+		metadata.PayloadVersionUnknown = fmt.Sprintf("finished.json has no %s", jobVersionKey)
+	}
+	return metadata, nil
+}
+
+// fetchClusterVersions reads version history of the tested cluster, recorded by gather-extra step.
+// Upgrade jobs have several versions there
+func (f *Fetcher) fetchClusterVersions(ctx context.Context, clusterVersionURL string) ([]string, error) {
+	var clusterVersion clusterVersionJSON
+	if err := f.getJSON(ctx, clusterVersionURL, &clusterVersion); err != nil {
+		return nil, err
+	}
+	if len(clusterVersion.Items) == 0 {
+		return nil, fmt.Errorf("no ClusterVersion found in %s", clusterVersionURL)
+	}
+	history := clusterVersion.Items[0].Status.History
+	versions := make([]string, 0, len(history))
+	// History is sorted newest first
+	for i := len(history) - 1; i >= 0; i-- {
+		version := history[i].Version
+		if history[i].State != "Completed" {
+			version += " (" + strings.ToLower(history[i].State) + ")"
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// fetchJobMetrics reads values of metrics queried by gather-extra step
+func (f *Fetcher) fetchJobMetrics(ctx context.Context, rawURL string) (map[string]string, error) {
+	var metrics jobMetricsJSON
+	if err := f.getJSON(ctx, rawURL, &metrics); err != nil {
+		return nil, err
+	}
+	return metrics.values(), nil
+}
+
+// values flattens query results into metric{labels} => value pairs
+func (m jobMetricsJSON) values() map[string]string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := map[string]string{}
+	for _, name := range names {
+		for _, result := range m[name].Data.Result {
+			if len(values) == maxJobMetrics {
+				return values
+			}
+			// Instant query value is a [timestamp, "value"] pair
+			if len(result.Value) != 2 {
+				continue
+			}
+			value, ok := result.Value[1].(string)
+			if !ok {
+				continue
+			}
+			labels := map[string]string{}
+			for label, labelValue := range result.Metric {
+				if label != "__name__" {
+					labels[label] = labelValue
+				}
+			}
+			values[name+formatLabels(labels)] = value
+		}
+	}
+	return values
+}
+
+// jobMetrics formats job metrics sorted by name
+func (m *JobMetadata) jobMetrics() string {
+	keys := make([]string, 0, len(m.JobMetrics))
+	for key := range m.JobMetrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", key, m.JobMetrics[key]))
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// payloadVersion returns payload version, or explains why it is unknown
+func (m *JobMetadata) payloadVersion() string {
+	if m.PayloadVersion == "" && m.PayloadVersionUnknown != "" {
+		return fmt.Sprintf("%s: %s", unknownPayloadVersion, m.PayloadVersionUnknown)
+	}
+	return m.PayloadVersion
+}
+
+// annotations returns metadata as Deployment annotations
+func (m *JobMetadata) annotations() map[string]string {
+	annotations := map[string]string{}
+	for key, value := range map[string]string{
+		"job":              m.Job,
+		"job-type":         m.Type,
+		"job-url":          m.URL,
+		"refs":             strings.Join(m.Refs, ", "),
+		"cluster-profile":  m.ClusterProfile,
+		"platform":         m.Platform,
+		"payload-version":  m.payloadVersion(),
+		"cluster-versions": strings.Join(m.ClusterVersions, ", "),
+		"job-metrics":      m.jobMetrics(),
+	} {
+		if value != "" {
+			annotations[metadataAnnotationPrefix+key] = value
+		}
+	}
+	return annotations
+}
@@ -0,0 +1,115 @@
+package promecieus
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestFetchClusterVersions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"kind": "List", "items": [{"kind": "ClusterVersion", "status": {"history": [
+			{"version": "4.16.0-0.nightly-2024-05-01-000000", "state": "Partial"},
+			{"version": "4.15.10", "state": "Completed"}
+		]}}]}`)
+	}))
+	defer server.Close()
+
+	versions, err := testFetcher().fetchClusterVersions(context.Background(), server.URL+"/clusterversion.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"4.15.10", "4.16.0-0.nightly-2024-05-01-000000 (partial)"}
+	if !reflect.DeepEqual(versions, expected) {
+		t.Errorf("expected %q, got %q", expected, versions)
+	}
+}
+
+func TestJobMetadataAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		metadata JobMetadata
+		expected map[string]string
+	}{
+		{
+			name: "known payload version",
+			metadata: JobMetadata{
+				Job:             "periodic-ci-job",
+				Type:            "periodic",
+				PayloadVersion:  "4.16.0-0.nightly-2024-05-01-000000",
+				ClusterVersions: []string{"4.15.10", "4.16.0-0.nightly-2024-05-01-000000"},
+			},
+			expected: map[string]string{
+				metadataAnnotationPrefix + "job":              "periodic-ci-job",
+				metadataAnnotationPrefix + "job-type":         "periodic",
+				metadataAnnotationPrefix + "payload-version":  "4.16.0-0.nightly-2024-05-01-000000",
+				metadataAnnotationPrefix + "cluster-versions": "4.15.10, 4.16.0-0.nightly-2024-05-01-000000",
+			},
+		},
+		{
+			name:     "unknown payload version",
+			metadata: JobMetadata{Job: "periodic-ci-job", PayloadVersionUnknown: "finished.json is missing or unreadable"},
+			expected: map[string]string{
+				metadataAnnotationPrefix + "job":             "periodic-ci-job",
+				metadataAnnotationPrefix + "payload-version": "unknown: finished.json is missing or unreadable",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if annotations := tc.metadata.annotations(); !reflect.DeepEqual(annotations, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, annotations)
+			}
+		})
+	}
+}
+
+func TestFetchJobMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{
+			"cluster:cpu_usage_cores:sum": {"status": "success", "data": {"resultType": "vector", "result": [
+				{"metric": {"__name__": "cluster:cpu_usage_cores:sum"}, "value": [1714521600, "12.5"]}
+			]}},
+			"cluster:node_instance_type_count:sum": {"status": "success", "data": {"resultType": "vector", "result": [
+				{"metric": {"label_node_role_kubernetes_io": "master"}, "value": [1714521600, "3"]},
+				{"metric": {"label_node_role_kubernetes_io": "worker"}, "value": [1714521600, "3"]}
+			]}},
+			"broken": {"status": "success", "data": {"resultType": "vector", "result": [{"metric": {}, "value": []}]}}
+		}`)
+	}))
+	defer server.Close()
+
+	metrics, err := testFetcher().fetchJobMetrics(context.Background(), server.URL+"/job_metrics.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"cluster:cpu_usage_cores:sum": "12.5",
+		`cluster:node_instance_type_count:sum{label_node_role_kubernetes_io="master"}`: "3",
+		`cluster:node_instance_type_count:sum{label_node_role_kubernetes_io="worker"}`: "3",
+	}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("expected %q, got %q", expected, metrics)
+	}
+
+	metadata := &JobMetadata{Job: "job", JobMetrics: map[string]string{"b": "2", "a": "1"}}
+	if value := metadata.annotations()[metadataAnnotationPrefix+"job-metrics"]; value != "a=1, b=2" {
+		t.Errorf("expected job metrics annotation to be sorted, got %q", value)
+	}
+}
+
+func TestUseCandidateJobMetrics(t *testing.T) {
+	shared := &JobMetadata{Job: "job"}
+	main := ProwInfo{Metadata: shared}
+	main.useCandidate(MetricsCandidate{Test: "e2e", URL: "main", jobMetrics: map[string]string{"up": "1"}})
+	pair := ProwInfo{Metadata: shared}
+	pair.useCandidate(MetricsCandidate{Test: "e2e", URL: "pair"})
+	if main.Metadata.JobMetrics["up"] != "1" {
+		t.Errorf("expected job metrics of the selected candidate, got %v", main.Metadata.JobMetrics)
+	}
+	if pair.Metadata.JobMetrics != nil || shared.JobMetrics != nil {
+		t.Error("expected job metrics not to leak into shared metadata")
+	}
+}
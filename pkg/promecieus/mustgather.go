@@ -0,0 +1,296 @@
+package promecieus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	mustGatherName = "must-gather"
+	// mustGatherLocalDir is the prefix of directories created by oc adm must-gather
+	mustGatherLocalDir = "must-gather.local."
+	// gatherStepDir is the prefix of CI steps which collect must-gather and other artifacts
+	gatherStepDir = "gather-"
+	// mustGatherSearchDepth limits how deep must-gather directories are searched for archives
+	mustGatherSearchDepth = 6
+)
+
+// errPartialArchive is returned when prometheus data is not found in the part of archive which was read
+var errPartialArchive = errors.New("archive was read partially")
+
+// archiveExtensions are file name suffixes of archives which may contain prometheus data
+var archiveExtensions = []string{".tar", ".tar.gz", ".tgz", ".tar.zst", ".tar.zstd"}
+
+// isArchiveName checks if the file name looks like a tarball
+func isArchiveName(name string) bool {
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMustGatherDir checks if the folder name is a must-gather output or a CI gather step
+func isMustGatherDir(name string) bool {
+	return strings.HasPrefix(name, mustGatherLocalDir) || strings.HasPrefix(name, gatherStepDir)
+}
+
+// isMustGatherArchive checks if the file name is a must-gather tarball
+func isMustGatherArchive(name string) bool {
+	return strings.HasPrefix(name, mustGatherName) && isArchiveName(name)
+}
+
+// mustGatherResolver finds prometheus data directories inside must-gather tarballs.
+// Must-gather directories are searched for tarballs first, then for unpacked data directories
+type mustGatherResolver struct {
+	fetcher *Fetcher
+	// lister lists GCS directories
+	lister artifactLister
+	// dirs lists directories on other HTTP servers
+	dirs artifactStore
+}
+
+func (m *mustGatherResolver) Name() string {
+	return mustGatherName
+}
+
+// Match accepts must-gather tarballs and links into must-gather directories.
+// Prow links are parsed first, so that only the path inside the job run is checked,
+// as job names may mention must-gather too
+func (m *mustGatherResolver) Match(u *url.URL) bool {
+	if !isHTTPURL(u) {
+		return false
+	}
+	segments := splitPath(u.Path)
+	if job, err := ParseProwURL(u); err == nil {
+		buildIndex := slices.Index(segments, job.BuildID)
+		if job.BuildID == "" || buildIndex < 0 {
+			return false
+		}
+		segments = segments[buildIndex+1:]
+	}
+	for i, segment := range segments {
+		if i == len(segments)-1 && isMustGatherArchive(segment) {
+			return true
+		}
+		if isMustGatherDir(segment) {
+			// Only links which Resolve can fetch or list are accepted
+			_, _, _, ok := m.locate(u)
+			return isArchiveName(u.Path) || ok
+		}
+	}
+	return false
+}
+
+// locate returns the store which lists the must-gather directory, its bucket and prefix
+func (m *mustGatherResolver) locate(u *url.URL) (artifactStore, string, string, bool) {
+	if objectPath, err := gcsObjectPath(u); err == nil && len(objectPath) >= 2 {
+		return &gcsStore{m.lister}, objectPath[0], strings.Join(objectPath[1:], "/") + "/", true
+	}
+	if bucket, prefix, ok := locateHTTPDir(u); ok && m.dirs != nil {
+		return m.dirs, bucket, prefix, true
+	}
+	return nil, "", "", false
+}
+
+func (m *mustGatherResolver) Resolve(ctx context.Context, u *url.URL) (ProwInfo, error) {
+	archiveURL := *u
+	archiveURL.RawQuery = ""
+	if isArchiveName(u.Path) {
+		return m.resolveArchive(ctx, strings.Replace(archiveURL.String(), gcsPrefix+"/gcs", storagePrefix, -1))
+	}
+
+	store, bucket, prefix, ok := m.locate(u)
+	if !ok {
+		return ProwInfo{}, fmt.Errorf("%s is neither a must-gather archive nor a directory which can be listed", u)
+	}
+	found := &mustGatherContents{}
+	if err := m.search(ctx, store, bucket, prefix, mustGatherSearchDepth, found); err != nil {
+		return ProwInfo{}, err
+	}
+	// Archives with must-gather in the name go first
+	sort.SliceStable(found.archives, func(i, j int) bool {
+		return strings.Contains(path.Base(found.archives[i]), mustGatherName) && !strings.Contains(path.Base(found.archives[j]), mustGatherName)
+	})
+	partial := []string{}
+	for _, archive := range found.archives {
+		prowInfo, err := m.resolveArchive(ctx, store.ObjectURL(bucket, archive))
+		if err == nil {
+			return prowInfo, nil
+		}
+		if errors.Is(err, errPartialArchive) {
+			partial = append(partial, archive)
+		}
+		klog.Infof("No prometheus data found in %s: %v", archive, err)
+	}
+	if len(found.dataDirs) > 0 {
+		sort.Strings(found.dataDirs)
+		if len(found.dataDirs) > 1 {
+			klog.Infof("Found several prometheus data directories in %s, using %s: %v", u, found.dataDirs[0], found.dataDirs)
+		}
+		return m.resolveDataDir(ctx, store, bucket, prefix, found.dataDirs[0])
+	}
+	if len(partial) > 0 {
+		return ProwInfo{}, fmt.Errorf("no prometheus data found in the first %dMiB of %s, it may be further in the archives: %s",
+			tsdbStreamLimit/1024/1024, u, strings.Join(partial, ", "))
+	}
+	return ProwInfo{}, fmt.Errorf("no archive with prometheus data found in %s", u)
+}
+
+// mustGatherContents are tarballs and unpacked prometheus data directories found in must-gather
+type mustGatherContents struct {
+	archives []string
+	dataDirs []string
+}
+
+// search lists tarballs and data directories in the directory and its subdirectories.
+// Data directories contain WAL or blocks and are not searched further
+func (m *mustGatherResolver) search(ctx context.Context, store artifactStore, bucket, prefix string, depth int, found *mustGatherContents) error {
+	listing, err := store.List(ctx, bucket, prefix)
+	if err != nil {
+		return err
+	}
+	for _, obj := range listing.Objects {
+		if isArchiveName(obj.Name) {
+			found.archives = append(found.archives, obj.Name)
+		}
+	}
+	for _, subfolder := range listing.Prefixes {
+		if name := folderName(subfolder); name == walDir || isBlockULID(name) {
+			found.dataDirs = append(found.dataDirs, prefix)
+			return nil
+		}
+	}
+	if depth == 0 {
+		return nil
+	}
+	for _, subfolder := range listing.Prefixes {
+		if err := m.search(ctx, store, bucket, subfolder, depth-1, found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveDataDir bundles files of unpacked data directory into an archive, which is served by staging.
+// Files are named relative to the requested directory, so the data directory becomes the archive root
+func (m *mustGatherResolver) resolveDataDir(ctx context.Context, store artifactStore, bucket, prefix, dataDir string) (ProwInfo, error) {
+	files, err := m.listFiles(ctx, store, bucket, dataDir, mustGatherSearchDepth)
+	if err != nil {
+		return ProwInfo{}, err
+	}
+	archive := MetricsArchive{
+		URL:    store.ObjectURL(bucket, dataDir),
+		Root:   strings.TrimSuffix(strings.TrimPrefix(dataDir, prefix), "/"),
+		Format: FormatTar,
+	}
+	var size int64
+	for _, obj := range files {
+		file := ArchiveFile{
+			Name: strings.TrimPrefix(obj.Name, prefix),
+			URL:  store.ObjectURL(bucket, obj.Name),
+			Size: obj.Size,
+		}
+		// gcsweb and autoindex listings have no sizes
+		if file.Size == 0 {
+			if file.Size, err = m.objectSize(ctx, file.URL); err != nil {
+				return ProwInfo{}, err
+			}
+		}
+		archive.Files = append(archive.Files, file)
+		size += file.Size
+	}
+	// Time range is read from the blocks later
+	return ProwInfo{
+		MetricsURL: archive.URL,
+		Size:       size,
+		Archives:   []MetricsArchive{archive},
+		Started:    time.Now(),
+		Finished:   time.Now(),
+	}, nil
+}
+
+// listFiles lists all objects in the directory and its subdirectories
+func (m *mustGatherResolver) listFiles(ctx context.Context, store artifactStore, bucket, prefix string, depth int) ([]gcsObject, error) {
+	listing, err := store.List(ctx, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	files := listing.Objects
+	if depth == 0 {
+		return files, nil
+	}
+	for _, subfolder := range listing.Prefixes {
+		found, err := m.listFiles(ctx, store, bucket, subfolder, depth-1)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, found...)
+	}
+	return files, nil
+}
+
+// objectSize reads object size from HEAD response
+func (m *mustGatherResolver) objectSize(ctx context.Context, objectURL string) (int64, error) {
+	resp, err := m.fetcher.Head(ctx, objectURL)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to check %s: returned %s", objectURL, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("failed to check %s: no content length returned", objectURL)
+	}
+	return resp.ContentLength, nil
+}
+
+// resolveArchive looks for prometheus data directories in the archive
+func (m *mustGatherResolver) resolveArchive(ctx context.Context, archiveURL string) (ProwInfo, error) {
+	prowInfo := ProwInfo{MetricsURL: archiveURL}
+	head, err := m.fetcher.checkArchive(ctx, archiveURL)
+	if err != nil {
+		return prowInfo, err
+	}
+	contents, err := m.fetcher.readArchiveContents(ctx, archiveURL, head)
+	if err != nil {
+		return prowInfo, err
+	}
+	if len(contents.dataDirs) == 0 && contents.Partial {
+		return prowInfo, fmt.Errorf("%w: no prometheus data found in the first %dMiB of %s", errPartialArchive, tsdbStreamLimit/1024/1024, archiveURL)
+	}
+	if len(contents.dataDirs) == 0 {
+		return prowInfo, fmt.Errorf("no prometheus data found in %s", archiveURL)
+	}
+	dataDirs := make([]string, 0, len(contents.dataDirs))
+	for dataDir := range contents.dataDirs {
+		dataDirs = append(dataDirs, dataDir)
+	}
+	sort.Strings(dataDirs)
+	if len(dataDirs) > 1 {
+		klog.Infof("Found several prometheus data directories in %s, using %s: %v", archiveURL, dataDirs[0], dataDirs)
+	}
+
+	prowInfo.Size = head.Size
+	root := dataDirs[0]
+	if root == "." {
+		root = ""
+	}
+	prowInfo.Archives = []MetricsArchive{{URL: archiveURL, Root: root}}
+	// Time range is read from the blocks later
+	prowInfo.Finished = time.Now()
+	prowInfo.Started = time.Now()
+	return prowInfo, nil
+}
@@ -0,0 +1,170 @@
+package promecieus
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mapLister returns listings by prefix
+type mapLister map[string]*gcsListing
+
+func (m mapLister) List(ctx context.Context, bucket, prefix string) (*gcsListing, error) {
+	if listing, ok := m[prefix]; ok {
+		return listing, nil
+	}
+	return nil, fmt.Errorf("%s not found", prefix)
+}
+
+func TestMustGatherMatch(t *testing.T) {
+	resolver := &mustGatherResolver{dirs: &httpDirStore{}}
+	for _, tc := range []struct {
+		url      string
+		expected bool
+	}{
+		{url: "https://example.com/must-gather.tar.gz", expected: true},
+		{url: "https://example.com/cases/123/must-gather-openshift.tar.zst", expected: true},
+		{url: "https://example.com/cases/123/must-gather.local.5437211/", expected: true},
+		{url: "https://gcsweb-ci.apps.ci.l2s4.p1.openshiftapps.com/gcs/test-platform-results/logs/periodic-ci-job/1790000000000000000/artifacts/e2e/gather-must-gather/", expected: true},
+		{url: "https://storage.googleapis.com/test-platform-results/logs/periodic-ci-job/1790000000000000000/artifacts/e2e/gather-must-gather/artifacts/must-gather.tar", expected: true},
+		// Job names mentioning must-gather are handled by the prow resolver
+		{url: "https://prow.ci.openshift.org/view/gs/test-platform-results/logs/periodic-ci-openshift-must-gather-e2e/1790000000000000000"},
+		{url: "https://prow.ci.openshift.org/job-history/gs/test-platform-results/logs/periodic-ci-openshift-must-gather-e2e"},
+		{url: "https://storage.googleapis.com/test-platform-results/logs/periodic-ci-openshift-must-gather-e2e/1790000000000000000/artifacts/e2e/"},
+		// Other schemes are handled by storage specific resolvers
+		{url: "s3://bucket/must-gather.tar.gz"},
+		{url: "https://example.com/must-gather-notes.txt"},
+		{url: "https://example.com/metrics/prometheus.tar"},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resolver.Match(u) != tc.expected {
+				t.Errorf("expected match to be %v", tc.expected)
+			}
+		})
+	}
+
+	// Without directory listing support only GCS directories can be resolved
+	u, _ := url.Parse("https://example.com/cases/123/must-gather.local.5437211/")
+	if (&mustGatherResolver{}).Match(u) {
+		t.Error("expected HTTP directory not to be matched without directory lister")
+	}
+}
+
+func TestMustGatherResolveDataDir(t *testing.T) {
+	const (
+		mg        = "cases/123/must-gather.local.1/"
+		dbDir     = mg + "monitoring/prometheus/prometheus-k8s-0/prometheus-db/"
+		block     = dbDir + "01HXYZ0000000000000000ABCD/"
+		walPrefix = dbDir + "wal/"
+	)
+	resolver := &mustGatherResolver{lister: mapLister{
+		mg:                            {Prefixes: []string{mg + "monitoring/"}, Objects: []gcsObject{{Name: mg + "version", Size: 10}}},
+		mg + "monitoring/":            {Prefixes: []string{mg + "monitoring/prometheus/"}},
+		mg + "monitoring/prometheus/": {Prefixes: []string{mg + "monitoring/prometheus/prometheus-k8s-0/"}},
+		mg + "monitoring/prometheus/prometheus-k8s-0/": {Prefixes: []string{dbDir}},
+		dbDir:             {Prefixes: []string{block, walPrefix}},
+		block:             {Prefixes: []string{block + "chunks/"}, Objects: []gcsObject{{Name: block + "meta.json", Size: 100}, {Name: block + "index", Size: 2000}}},
+		block + "chunks/": {Objects: []gcsObject{{Name: block + "chunks/000001", Size: 30000}}},
+		walPrefix:         {Objects: []gcsObject{{Name: walPrefix + "00000000", Size: 4000}}},
+	}}
+
+	u, err := url.Parse("https://storage.googleapis.com/customer-data/" + mg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prowInfo, err := resolver.Resolve(context.Background(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prowInfo.Archives) != 1 {
+		t.Fatalf("expected a single archive, got %+v", prowInfo.Archives)
+	}
+	archive := prowInfo.Archives[0]
+	if archive.Root != "monitoring/prometheus/prometheus-k8s-0/prometheus-db" {
+		t.Errorf("expected data directory to be the archive root, got %q", archive.Root)
+	}
+	if archive.URL != gcsObjectURL("customer-data", dbDir) || prowInfo.MetricsURL != archive.URL {
+		t.Errorf("unexpected archive URL %s", archive.URL)
+	}
+	names := []string{}
+	for _, file := range archive.Files {
+		names = append(names, file.Name)
+	}
+	expected := []string{
+		"monitoring/prometheus/prometheus-k8s-0/prometheus-db/01HXYZ0000000000000000ABCD/meta.json",
+		"monitoring/prometheus/prometheus-k8s-0/prometheus-db/01HXYZ0000000000000000ABCD/index",
+		"monitoring/prometheus/prometheus-k8s-0/prometheus-db/01HXYZ0000000000000000ABCD/chunks/000001",
+		"monitoring/prometheus/prometheus-k8s-0/prometheus-db/wal/00000000",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected files %q, got %q", expected, names)
+	}
+	if prowInfo.Size != 36100 {
+		t.Errorf("expected total size 36100, got %d", prowInfo.Size)
+	}
+}
+
+func TestMustGatherResolveHTTPDataDir(t *testing.T) {
+	files := map[string]string{
+		"/cases/123/must-gather.local.1/monitoring/prometheus-db/01HXYZ0000000000000000ABCD/meta.json": "{}",
+		"/cases/123/must-gather.local.1/monitoring/prometheus-db/wal/00000000":                         "segment",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if content, ok := files[r.URL.Path]; ok {
+			w.Write([]byte(content))
+			return
+		}
+		// Autoindex listing of direct children
+		children := map[string]bool{}
+		for name := range files {
+			if child, ok := strings.CutPrefix(name, r.URL.Path); ok {
+				if i := strings.Index(child, "/"); i >= 0 {
+					child = child[:i+1]
+				}
+				children[child] = true
+			}
+		}
+		if len(children) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `<html><body><a href="../">../</a>`)
+		for child := range children {
+			fmt.Fprintf(w, `<a href="%s">%s</a>`, child, child)
+		}
+		fmt.Fprint(w, `</body></html>`)
+	}))
+	defer server.Close()
+	fetcher := testFetcher()
+	resolver := &mustGatherResolver{fetcher: fetcher, dirs: &httpDirStore{fetcher: fetcher}}
+
+	u, err := url.Parse(server.URL + "/cases/123/must-gather.local.1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resolver.Match(u) {
+		t.Fatal("expected must-gather directory to be matched")
+	}
+	prowInfo, err := resolver.Resolve(context.Background(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prowInfo.Archives) != 1 || prowInfo.Archives[0].Root != "monitoring/prometheus-db" {
+		t.Fatalf("expected data directory to be the archive root, got %+v", prowInfo.Archives)
+	}
+	if len(prowInfo.Archives[0].Files) != 2 || prowInfo.Size != int64(len("{}")+len("segment")) {
+		t.Errorf("expected both files with sizes, got %+v", prowInfo.Archives[0].Files)
+	}
+	if prowInfo.MetricsURL != server.URL+"/cases/123/must-gather.local.1/monitoring/prometheus-db/" {
+		t.Errorf("unexpected archive URL %s", prowInfo.MetricsURL)
+	}
+}
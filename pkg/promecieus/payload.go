@@ -0,0 +1,165 @@
+package promecieus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"k8s.io/klog/v2"
+)
+
+const (
+	releaseStreamPath = "releasestream"
+	releasePath       = "release"
+)
+
+// PayloadJob is a job run which verified release payload
+type PayloadJob struct {
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	URL      string `json:"url"`
+	Blocking bool   `json:"blocking"`
+}
+
+// Payload is a release payload with its verification job runs
+type Payload struct {
+	Name  string       `json:"name"`
+	Phase string       `json:"phase"`
+	Jobs  []PayloadJob `json:"jobs"`
+}
+
+// releaseControllerJob is a verification job state as returned by release-controller API
+type releaseControllerJob struct {
+	State string `json:"state"`
+	URL   string `json:"url"`
+}
+
+// releaseControllerPayload is release-controller API response
+type releaseControllerPayload struct {
+	Name    string `json:"name"`
+	Phase   string `json:"phase"`
+	Results struct {
+		BlockingJobs  map[string]releaseControllerJob `json:"blockingJobs"`
+		InformingJobs map[string]releaseControllerJob `json:"informingJobs"`
+	} `json:"results"`
+}
+
+// payloadAPIURL converts release-controller payload page URL into API URL
+func payloadAPIURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse payload URL %s: %v", rawURL, err)
+	}
+	segments := splitPath(u.Path)
+	// API links are accepted as is
+	if len(segments) > 2 && segments[0] == "api" {
+		segments = segments[2:]
+	}
+	if len(segments) != 4 || segments[0] != releaseStreamPath || segments[2] != releasePath {
+		return "", fmt.Errorf("%s is not a release payload link", rawURL)
+	}
+	apiURL := url.URL{
+		Scheme: u.Scheme,
+		Host:   u.Host,
+		Path:   fmt.Sprintf("/api/v1/%s/%s/%s/%s", releaseStreamPath, segments[1], releasePath, segments[3]),
+	}
+	return apiURL.String(), nil
+}
+
+// fetchPayload reads payload verification jobs from release-controller
+func (s *ServerSettings) fetchPayload(ctx context.Context, rawURL string) (*Payload, error) {
+	apiURL, err := payloadAPIURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.Fetcher.Get(ctx, apiURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: returned %s", apiURL, resp.Status)
+	}
+
+	var rcPayload releaseControllerPayload
+	if err := json.NewDecoder(resp.Body).Decode(&rcPayload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal payload at %s: %v", apiURL, err)
+	}
+
+	payload := &Payload{
+		Name:  rcPayload.Name,
+		Phase: rcPayload.Phase,
+		Jobs:  []PayloadJob{},
+	}
+	for name, job := range rcPayload.Results.BlockingJobs {
+		payload.Jobs = append(payload.Jobs, PayloadJob{Name: name, State: job.State, URL: job.URL, Blocking: true})
+	}
+	for name, job := range rcPayload.Results.InformingJobs {
+		payload.Jobs = append(payload.Jobs, PayloadJob{Name: name, State: job.State, URL: job.URL})
+	}
+	// Blocking jobs go first
+	sort.Slice(payload.Jobs, func(i, j int) bool {
+		if payload.Jobs[i].Blocking != payload.Jobs[j].Blocking {
+			return payload.Jobs[i].Blocking
+		}
+		return payload.Jobs[i].Name < payload.Jobs[j].Name
+	})
+	return payload, nil
+}
+
+// HandlePayload lists release payload job runs
+func (s *ServerSettings) HandlePayload(c *gin.Context) {
+	rawURL := c.Query("url")
+	if rawURL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url param is required"})
+		return
+	}
+	payload, err := s.fetchPayload(c.Request.Context(), rawURL)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, payload)
+}
+
+// sendPayload sends release payload job runs to the websocket
+func (s *ServerSettings) sendPayload(ctx context.Context, conn *websocket.Conn, rawURL string) {
+	sendWSMessage(conn, "status", fmt.Sprintf("Fetching release payload %s", rawURL))
+	payload, err := s.fetchPayload(ctx, rawURL)
+	if err != nil {
+		sendWSMessage(conn, "failure", fmt.Sprintf("Failed to fetch release payload: %s", err.Error()))
+		return
+	}
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		klog.Fatalf("Can't serialize %v", payload)
+	}
+	sendWSMessage(conn, "payload", string(payloadJSON))
+}
+
+// launchPayloadJobs starts a prometheus instance for every selected job run.
+// Instances are started one by one, as the page tracks a single instance being created,
+// so archive selection and cancellation have to target the current one
+func (s *ServerSettings) launchPayloadJobs(ctx context.Context, conn *websocket.Conn, jobsJSON string) {
+	var jobURLs []string
+	if err := json.Unmarshal([]byte(jobsJSON), &jobURLs); err != nil {
+		sendWSMessage(conn, "failure", fmt.Sprintf("Failed to parse selected jobs: %s", err.Error()))
+		return
+	}
+	if available := s.RQStatus.Hard - s.RQStatus.Used; s.RQStatus.Hard > 0 && int64(len(jobURLs)) > available {
+		sendWSMessage(conn, "status", fmt.Sprintf("Only %d pods are available in the quota, some of %d instances may not start", available, len(jobURLs)))
+	}
+	for i, jobURL := range jobURLs {
+		if ctx.Err() != nil {
+			return
+		}
+		sendWSMessage(conn, "status", fmt.Sprintf("Launching job %d of %d: %s", i+1, len(jobURLs), jobURL))
+		s.createNewPrometheus(ctx, conn, jobURL)
+	}
+}
@@ -0,0 +1,116 @@
+package promecieus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPayloadAPIURL(t *testing.T) {
+	for _, tc := range []struct {
+		url      string
+		expected string
+	}{
+		{
+			url:      "https://amd64.ocp.releases.ci.openshift.org/releasestream/4.16.0-0.nightly/release/4.16.0-0.nightly-2024-05-01-000000",
+			expected: "https://amd64.ocp.releases.ci.openshift.org/api/v1/releasestream/4.16.0-0.nightly/release/4.16.0-0.nightly-2024-05-01-000000",
+		},
+		{
+			url:      "https://amd64.ocp.releases.ci.openshift.org/api/v1/releasestream/4-stable/release/4.15.10",
+			expected: "https://amd64.ocp.releases.ci.openshift.org/api/v1/releasestream/4-stable/release/4.15.10",
+		},
+		{url: "https://amd64.ocp.releases.ci.openshift.org/releasestream/4-stable"},
+		{url: "https://amd64.ocp.releases.ci.openshift.org/releasetag/4.15.10"},
+		{url: "https://prow.ci.openshift.org/view/gs/test-platform-results/logs/job/1"},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			apiURL, err := payloadAPIURL(tc.url)
+			if tc.expected == "" {
+				if err == nil {
+					t.Errorf("expected error, got %s", apiURL)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if apiURL != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, apiURL)
+			}
+		})
+	}
+}
+
+func TestHandlePayload(t *testing.T) {
+	releaseController := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/releasestream/4.16.0-0.nightly/release/4.16.0-0.nightly-2024-05-01-000000" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{
+			"name": "4.16.0-0.nightly-2024-05-01-000000",
+			"phase": "Rejected",
+			"results": {
+				"blockingJobs": {
+					"aws-ovn": {"state": "Failed", "url": "https://prow.ci.openshift.org/view/gs/test-platform-results/logs/aws-ovn/1"}
+				},
+				"informingJobs": {
+					"metal-ipi": {"state": "Succeeded", "url": "https://prow.ci.openshift.org/view/gs/test-platform-results/logs/metal-ipi/2"},
+					"azure-ovn": {"state": "Pending", "url": "https://prow.ci.openshift.org/view/gs/test-platform-results/logs/azure-ovn/3"}
+				}
+			}
+		}`)
+	}))
+	defer releaseController.Close()
+
+	gin.SetMode(gin.TestMode)
+	s := &ServerSettings{Fetcher: testFetcher()}
+	r := gin.New()
+	r.GET("/api/payload", s.HandlePayload)
+
+	get := func(payloadURL string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/payload?url="+url.QueryEscape(payloadURL), nil)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(releaseController.URL + "/releasestream/4.16.0-0.nightly/release/4.16.0-0.nightly-2024-05-01-000000")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var payload Payload
+	if err := json.Unmarshal(w.Body.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+	expected := Payload{
+		Name:  "4.16.0-0.nightly-2024-05-01-000000",
+		Phase: "Rejected",
+		Jobs: []PayloadJob{
+			{Name: "aws-ovn", State: "Failed", URL: "https://prow.ci.openshift.org/view/gs/test-platform-results/logs/aws-ovn/1", Blocking: true},
+			{Name: "azure-ovn", State: "Pending", URL: "https://prow.ci.openshift.org/view/gs/test-platform-results/logs/azure-ovn/3"},
+			{Name: "metal-ipi", State: "Succeeded", URL: "https://prow.ci.openshift.org/view/gs/test-platform-results/logs/metal-ipi/2"},
+		},
+	}
+	if !reflect.DeepEqual(payload, expected) {
+		t.Errorf("expected blocking jobs first, then sorted by name: %+v, got %+v", expected, payload)
+	}
+
+	if w := get(releaseController.URL + "/releasestream/4.16.0-0.nightly/release/missing"); w.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 for missing payload, got %d", w.Code)
+	}
+	if w := get(releaseController.URL + "/releasestream/4.16.0-0.nightly"); w.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 for non-payload link, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/payload", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without url, got %d", w.Code)
+	}
+}
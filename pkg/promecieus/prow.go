@@ -0,0 +1,436 @@
+package promecieus
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"k8s.io/klog/v2"
+)
+
+const (
+	clusterManagement = "management"
+	clusterHosted     = "hosted"
+)
+
+// prowResolver finds Prow job artifacts in GCS and looks for metrics archive there
+type prowResolver struct {
+	fetcher *Fetcher
+	lister  artifactLister
+}
+
+func (p *prowResolver) Name() string {
+	return "prow"
+}
+
+func (p *prowResolver) Match(u *url.URL) bool {
+	_, err := ParseProwURL(u)
+	return err == nil
+}
+
+func (p *prowResolver) Resolve(ctx context.Context, baseURL *url.URL) (ProwInfo, error) {
+	job, err := ParseProwURL(baseURL)
+	if err != nil {
+		return ProwInfo{}, err
+	}
+	return p.resolveJob(ctx, job)
+}
+
+// resolveJob finds start/stop markers and metrics archives of the job run
+func (p *prowResolver) resolveJob(ctx context.Context, job *ProwJob) (ProwInfo, error) {
+	prowInfo := ProwInfo{Job: job}
+	bucket := job.Bucket
+
+	// Job history links point to the latest run
+	if job.BuildID == "" {
+		latestURL := gcsObjectURL(bucket, job.jobFolder()+"latest-build.txt")
+		buildID, err := p.fetcher.getTextFromURL(ctx, latestURL)
+		if err != nil {
+			return prowInfo, fmt.Errorf("failed to find latest build of %s: %v", job.Name, err)
+		}
+		if !isBuildID(buildID) {
+			return prowInfo, fmt.Errorf("invalid build ID %q found at %s", buildID, latestURL)
+		}
+		job.BuildID = buildID
+	}
+
+	// Presubmits from pr-logs/directory link to the actual run location
+	if !job.knownPath() {
+		linkURL := gcsObjectURL(bucket, job.jobFolder()+job.BuildID+".txt")
+		link, err := p.fetcher.getTextFromURL(ctx, linkURL)
+		if err != nil {
+			return prowInfo, fmt.Errorf("failed to find location of %s build %s: %v", job.Name, job.BuildID, err)
+		}
+		u, err := url.Parse(link)
+		if err != nil {
+			return prowInfo, fmt.Errorf("failed to parse link %s found at %s: %v", link, linkURL, err)
+		}
+		if job, err = ParseProwURL(u); err != nil {
+			return prowInfo, err
+		}
+		prowInfo.Job = job
+		bucket = job.Bucket
+	}
+	jobPath := job.Path()
+	klog.Infof("Found %s job %s build %s at %s", job.Type, job.Name, job.BuildID, gcsObjectURL(bucket, jobPath))
+
+	// Fetch start and finish time of the test
+	startTime, err := p.fetcher.getTimeStampFromProwJSON(ctx, gcsObjectURL(bucket, jobPath+"started.json"))
+	if err != nil {
+		return prowInfo, fmt.Errorf("failed to fetch test start time: %v", err)
+	}
+	prowInfo.Started = startTime
+
+	finishedTime, err := p.fetcher.getTimeStampFromProwJSON(ctx, gcsObjectURL(bucket, jobPath+"finished.json"))
+	if err != nil {
+		return prowInfo, fmt.Errorf("failed to fetch test finished time: %v", err)
+	}
+	prowInfo.Finished = finishedTime
+
+	klog.Infof("Found start/stop markers at %s", gcsObjectURL(bucket, jobPath))
+
+	// Job details are informational only, so instance is created without them
+	if metadata, err := p.fetcher.fetchJobMetadata(ctx, job); err != nil {
+		klog.Infof("failed to read metadata of %s build %s: %v", job.Name, job.BuildID, err)
+	} else {
+		prowInfo.Metadata = metadata
+	}
+
+	// Check that 'artifacts' folder is present
+	artifactsPrefix, err := p.findFolder(ctx, bucket, jobPath, func(name string) bool {
+		return name == artifactsPath
+	})
+	if err != nil {
+		return prowInfo, fmt.Errorf("failed to find artifacts folder: %v", err)
+	}
+
+	candidates, found, err := p.findCandidates(ctx, bucket, artifactsPrefix)
+	if err != nil {
+		return prowInfo, err
+	}
+	if len(candidates) == 0 {
+		return prowInfo, fmt.Errorf("no prometheus archives found in %s", gcsObjectURL(bucket, artifactsPrefix))
+	}
+	junitFiles := p.listJUnitFolders(ctx, bucket, found.junitFolders)
+	prowInfo.artifacts = &jobArtifacts{
+		failures: p.findTestFailures(ctx, bucket, junitFiles, prowInfo.Finished),
+		backfill: append(findIntervalFiles(bucket, junitFiles), found.events...),
+	}
+	klog.Infof("Found %d test failures in %d JUnit folders", len(prowInfo.artifacts.failures), len(found.junitFolders))
+	if prowInfo.Metadata != nil && found.clusterVersion != "" {
+		if versions, err := p.fetcher.fetchClusterVersions(ctx, found.clusterVersion); err != nil {
+			klog.Infof("failed to read cluster versions of %s build %s: %v", job.Name, job.BuildID, err)
+		} else {
+			prowInfo.Metadata.ClusterVersions = versions
+		}
+	}
+	labelHyperShiftClusters(candidates)
+	if prowInfo.Metadata != nil {
+		p.fetchJobMetrics(ctx, candidates)
+	}
+	prowInfo.Candidates = candidates
+	prowInfo.useCandidate(candidates[defaultCandidate(candidates)])
+	return prowInfo, nil
+}
+
+// fetchJobMetrics reads job metrics of each candidate, so that the selected one shows metrics of its test.
+// Archives of other steps get metrics of the same test and cluster
+func (p *prowResolver) fetchJobMetrics(ctx context.Context, candidates []MetricsCandidate) {
+	var wg sync.WaitGroup
+	for i := range candidates {
+		if candidates[i].jobMetricsURL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(c *MetricsCandidate) {
+			defer wg.Done()
+			metrics, err := p.fetcher.fetchJobMetrics(ctx, c.jobMetricsURL)
+			if err != nil {
+				klog.Infof("failed to read job metrics: %v", err)
+				return
+			}
+			c.jobMetrics = metrics
+		}(&candidates[i])
+	}
+	wg.Wait()
+	for i, c := range candidates {
+		if c.jobMetrics != nil {
+			continue
+		}
+		for _, other := range candidates {
+			if other.jobMetrics != nil && other.Test == c.Test && other.Cluster == c.Cluster {
+				candidates[i].jobMetrics = other.jobMetrics
+				break
+			}
+		}
+	}
+}
+
+// testArtifacts are other useful artifacts found while looking for metrics archives
+type testArtifacts struct {
+	junitFolders []junitFolder
+	events       []BackfillSource
+	// clusterVersion is the first ClusterVersion collected by gather-extra step
+	clusterVersion string
+}
+
+// findCandidates looks for metrics archive in every test and every step of the job.
+// JUnit results folders and cluster events found along the way are returned too
+func (p *prowResolver) findCandidates(ctx context.Context, bucket, artifactsPrefix string) ([]MetricsCandidate, *testArtifacts, error) {
+	artifactsListing, err := p.lister.List(ctx, bucket, artifactsPrefix)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list %s: %v", artifactsPrefix, err)
+	}
+
+	candidates := []MetricsCandidate{}
+	artifacts := &testArtifacts{}
+	for _, testPrefix := range artifactsListing.Prefixes {
+		testListing, err := p.lister.List(ctx, bucket, testPrefix)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list %s: %v", testPrefix, err)
+		}
+		test := folderName(testPrefix)
+
+		// Old-style jobs keep metrics and results in the test folder
+		if archives := p.findArchives(ctx, bucket, testPrefix, testListing); archives != nil {
+			candidates = append(candidates, archives.candidate(bucket, test, ""))
+		}
+		if slices.Contains(testListing.Prefixes, testPrefix+junitDir) {
+			artifacts.junitFolders = append(artifacts.junitFolders, junitFolder{prefix: testPrefix + junitDir, test: test})
+		}
+
+		// Multi-stage jobs keep metrics in step artifacts
+		var steps []string
+		for _, stepPrefix := range testListing.Prefixes {
+			switch folderName(stepPrefix) {
+			case artifactsPath, "gsutil", "metrics":
+				continue
+			default:
+				steps = append(steps, stepPrefix)
+			}
+		}
+		found := make([]*replicaArchives, len(steps))
+		junitFound := make([]string, len(steps))
+		eventsFound := make([]string, len(steps))
+		clusterVersionFound := make([]string, len(steps))
+		var wg sync.WaitGroup
+		for i, stepPrefix := range steps {
+			wg.Add(1)
+			go func(i int, stepPrefix string) {
+				defer wg.Done()
+				stepArtifactsPrefix := stepPrefix + artifactsPath + "/"
+				listing, err := p.lister.List(ctx, bucket, stepArtifactsPrefix)
+				if err != nil {
+					klog.Infof("failed to list %s: %v", stepArtifactsPrefix, err)
+					return
+				}
+				found[i] = p.findArchives(ctx, bucket, stepArtifactsPrefix, listing)
+				if slices.Contains(listing.Prefixes, stepArtifactsPrefix+junitDir) {
+					junitFound[i] = stepArtifactsPrefix + junitDir
+				}
+				// HyperShift management cluster dumps have their own events
+				step := folderName(stepPrefix)
+				if step == extraPath || isManagementClusterStep(step) {
+					for _, obj := range listing.Objects {
+						switch path.Base(obj.Name) {
+						case eventsFile:
+							eventsFound[i] = obj.Name
+						case clusterVersionFile:
+							if step == extraPath {
+								clusterVersionFound[i] = obj.Name
+							}
+						}
+					}
+				}
+			}(i, stepPrefix)
+		}
+		wg.Wait()
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		for i := range steps {
+			if junitFound[i] != "" {
+				artifacts.junitFolders = append(artifacts.junitFolders, junitFolder{prefix: junitFound[i], test: test, step: folderName(steps[i])})
+			}
+			if eventsFound[i] != "" {
+				artifacts.events = append(artifacts.events, BackfillSource{Kind: eventsKind, URL: gcsObjectURL(bucket, eventsFound[i]), Test: test, Step: folderName(steps[i])})
+			}
+			if clusterVersionFound[i] != "" && artifacts.clusterVersion == "" {
+				artifacts.clusterVersion = gcsObjectURL(bucket, clusterVersionFound[i])
+			}
+		}
+
+		for i, archives := range found {
+			if archives == nil {
+				continue
+			}
+			candidates = append(candidates, archives.candidate(bucket, test, folderName(steps[i])))
+		}
+	}
+	return candidates, artifacts, nil
+}
+
+// replicaArchives are snapshots of both prometheus-k8s replicas found in a folder
+type replicaArchives struct {
+	primary *gcsObject
+	replica *gcsObject
+	// jobMetrics is job_metrics.json gather-extra step stores next to the archives
+	jobMetrics *gcsObject
+}
+
+func (r *replicaArchives) candidate(bucket, test, step string) MetricsCandidate {
+	c := MetricsCandidate{
+		Test: test,
+		Step: step,
+	}
+	if r.primary != nil {
+		c.URL = gcsObjectURL(bucket, r.primary.Name)
+		c.Size = r.primary.Size
+	}
+	if r.replica != nil {
+		c.ReplicaURL = gcsObjectURL(bucket, r.replica.Name)
+		c.ReplicaSize = r.replica.Size
+	}
+	if r.jobMetrics != nil {
+		c.jobMetricsURL = gcsObjectURL(bucket, r.jobMetrics.Name)
+	}
+	return c
+}
+
+// findArchives returns metrics archives if folder has any
+func (p *prowResolver) findArchives(ctx context.Context, bucket, prefix string, listing *gcsListing) *replicaArchives {
+	metricsDir := path.Dir(promTarPath) + "/"
+	if !slices.Contains(listing.Prefixes, prefix+metricsDir) {
+		return nil
+	}
+	metricsListing, err := p.lister.List(ctx, bucket, prefix+metricsDir)
+	if err != nil {
+		klog.Infof("failed to list %s: %v", prefix+metricsDir, err)
+		return nil
+	}
+	archives := &replicaArchives{}
+	for _, obj := range metricsListing.Objects {
+		switch path.Base(obj.Name) {
+		case path.Base(promTarPath):
+			klog.Infof("Found %s: %d bytes, updated at %s", obj.Name, obj.Size, obj.Updated)
+			archives.primary = &obj
+		case path.Base(prom2ndTarPath):
+			klog.Infof("Found %s: %d bytes, updated at %s", obj.Name, obj.Size, obj.Updated)
+			archives.replica = &obj
+		case jobMetricsFile:
+			archives.jobMetrics = &obj
+		}
+	}
+	if archives.primary == nil && archives.replica == nil {
+		return nil
+	}
+	return archives
+}
+
+// labelHyperShiftClusters marks archives of HyperShift jobs, which dump management and hosted clusters separately.
+// Once a test has management cluster dump, all other archives of this test belong to the hosted cluster
+func labelHyperShiftClusters(candidates []MetricsCandidate) {
+	managementTests := map[string]bool{}
+	for i, c := range candidates {
+		if isManagementClusterStep(c.Step) {
+			candidates[i].Cluster = clusterManagement
+			managementTests[c.Test] = true
+		}
+	}
+	for i, c := range candidates {
+		if managementTests[c.Test] && c.Cluster == "" {
+			candidates[i].Cluster = clusterHosted
+		}
+	}
+}
+
+// managementClusterSteps are steps of HyperShift workflows which gather artifacts of the management cluster.
+// Other hypershift steps, i.e. hosted cluster dumps, may have "hypershift" in their name too, so names are matched exactly
+var managementClusterSteps = []string{
+	hypershiftExtraPath,
+	"dump-management-cluster",
+	"hypershift-dump-management-cluster",
+}
+
+func isManagementClusterStep(step string) bool {
+	return slices.Contains(managementClusterSteps, step)
+}
+
+// defaultCandidate picks gather-extra archive of e2e test, which used to be the only supported option
+func defaultCandidate(candidates []MetricsCandidate) int {
+	for i, c := range candidates {
+		if strings.Contains(c.Test, e2ePrefix) && (c.Step == extraPath || c.Step == hypershiftExtraPath) {
+			return i
+		}
+	}
+	for i, c := range candidates {
+		if strings.Contains(c.Test, e2ePrefix) {
+			return i
+		}
+	}
+	return 0
+}
+
+// findFolder returns first subfolder of prefix which name matches
+func (p *prowResolver) findFolder(ctx context.Context, bucket, prefix string, match func(string) bool) (string, error) {
+	listing, err := p.lister.List(ctx, bucket, prefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to list %s: %v", prefix, err)
+	}
+	if len(listing.Prefixes) == 0 {
+		return "", fmt.Errorf("no folders found at %s", prefix)
+	}
+	for _, subfolder := range listing.Prefixes {
+		klog.Infof("folder: %s", subfolder)
+		if match(folderName(subfolder)) {
+			return subfolder, nil
+		}
+	}
+	return "", fmt.Errorf("no matching folder found in %v", listing.Prefixes)
+}
+
+// HandleResolve finds metrics archive for job name and build ID without fetching any deck pages
+func (s *ServerSettings) HandleResolve(c *gin.Context) {
+	job, err := jobFromParams(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	u, err := url.Parse(job.URL())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resolver, err := s.Resolvers.Find(u)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	prowInfo, err := resolver.Resolve(c.Request.Context(), u)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, prowInfo)
+}
+
+// createPrometheusForJob starts an instance for a job name and build ID
+func (s *ServerSettings) createPrometheusForJob(ctx context.Context, conn *websocket.Conn, data map[string]string) {
+	params := url.Values{}
+	for k, v := range data {
+		params.Set(k, v)
+	}
+	job, err := jobFromParams(params)
+	if err != nil {
+		sendWSMessage(conn, "failure", fmt.Sprintf("Failed to find job: %s", err.Error()))
+		return
+	}
+	s.createNewPrometheus(ctx, conn, job.URL())
+}
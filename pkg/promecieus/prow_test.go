@@ -0,0 +1,116 @@
+package promecieus
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestLabelHyperShiftClusters(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		candidates []MetricsCandidate
+		expected   []string
+	}{
+		{
+			name: "management and hosted dumps of the same test",
+			candidates: []MetricsCandidate{
+				{Test: "e2e-aws-ovn", Step: extraPath},
+				{Test: "e2e-aws-ovn", Step: hypershiftExtraPath},
+			},
+			expected: []string{clusterHosted, clusterManagement},
+		},
+		{
+			name: "management cluster dump step",
+			candidates: []MetricsCandidate{
+				{Test: "e2e-hypershift", Step: "dump-management-cluster"},
+				{Test: "e2e-hypershift", Step: extraPath},
+			},
+			expected: []string{clusterManagement, clusterHosted},
+		},
+		{
+			name: "hosted cluster gather steps mentioning hypershift",
+			candidates: []MetricsCandidate{
+				{Test: "e2e-hypershift", Step: "hypershift-dump"},
+				{Test: "e2e-hypershift", Step: "gather-hypershift-hosted"},
+			},
+			expected: []string{"", ""},
+		},
+		{
+			name: "other tests are not labelled",
+			candidates: []MetricsCandidate{
+				{Test: "e2e-hypershift", Step: hypershiftExtraPath},
+				{Test: "e2e-hypershift", Step: extraPath},
+				{Test: "e2e-upgrade", Step: extraPath},
+			},
+			expected: []string{clusterManagement, clusterHosted, ""},
+		},
+		{
+			name: "regular job",
+			candidates: []MetricsCandidate{
+				{Test: "e2e-aws", Step: extraPath},
+				{Test: "e2e-aws", Step: "gather-mgmt-notes"},
+			},
+			expected: []string{"", ""},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			labelHyperShiftClusters(tc.candidates)
+			clusters := []string{}
+			for _, c := range tc.candidates {
+				clusters = append(clusters, c.Cluster)
+			}
+			if !reflect.DeepEqual(clusters, tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, clusters)
+			}
+		})
+	}
+}
+
+func TestFindCandidatesScopesEvents(t *testing.T) {
+	artifacts := "logs/job/1/artifacts/"
+	hosted := artifacts + "e2e-hypershift/" + extraPath + "/artifacts/"
+	management := artifacts + "e2e-hypershift/" + hypershiftExtraPath + "/artifacts/"
+	upgrade := artifacts + "e2e-upgrade/" + extraPath + "/artifacts/"
+	metrics := func(prefix string) *gcsListing {
+		return &gcsListing{Objects: []gcsObject{{Name: prefix + promTarPath, Size: 100}}}
+	}
+	p := &prowResolver{lister: mapLister{
+		artifacts:                     {Prefixes: []string{artifacts + "e2e-hypershift/", artifacts + "e2e-upgrade/"}},
+		artifacts + "e2e-hypershift/": {Prefixes: []string{artifacts + "e2e-hypershift/" + extraPath + "/", artifacts + "e2e-hypershift/" + hypershiftExtraPath + "/"}},
+		artifacts + "e2e-upgrade/":    {Prefixes: []string{artifacts + "e2e-upgrade/" + extraPath + "/"}},
+		hosted:                        {Prefixes: []string{hosted + "metrics/"}, Objects: []gcsObject{{Name: hosted + eventsFile}, {Name: hosted + clusterVersionFile}}},
+		hosted + "metrics/":           metrics(hosted),
+		management:                    {Prefixes: []string{management + "metrics/"}, Objects: []gcsObject{{Name: management + eventsFile}}},
+		management + "metrics/":       metrics(management),
+		upgrade:                       {Prefixes: []string{upgrade + "metrics/"}, Objects: []gcsObject{{Name: upgrade + eventsFile}}},
+		upgrade + "metrics/":          metrics(upgrade),
+	}}
+
+	candidates, found, err := p.findCandidates(context.Background(), "bucket", artifacts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 3 {
+		t.Fatalf("expected 3 candidates, got %+v", candidates)
+	}
+	expected := []BackfillSource{
+		{Kind: eventsKind, URL: gcsObjectURL("bucket", hosted+eventsFile), Test: "e2e-hypershift", Step: extraPath},
+		{Kind: eventsKind, URL: gcsObjectURL("bucket", management+eventsFile), Test: "e2e-hypershift", Step: hypershiftExtraPath},
+		{Kind: eventsKind, URL: gcsObjectURL("bucket", upgrade+eventsFile), Test: "e2e-upgrade", Step: extraPath},
+	}
+	if !reflect.DeepEqual(found.events, expected) {
+		t.Errorf("expected %+v, got %+v", expected, found.events)
+	}
+	if found.clusterVersion != gcsObjectURL("bucket", hosted+clusterVersionFile) {
+		t.Errorf("expected cluster version of gather-extra step, got %s", found.clusterVersion)
+	}
+
+	labelHyperShiftClusters(candidates)
+	for _, c := range candidates {
+		sources := testBackfill(found.events, c)
+		if len(sources) != 1 || sources[0].Test != c.Test || sources[0].Step != c.Step {
+			t.Errorf("expected %s/%s to get events of its own step, got %+v", c.Test, c.Step, sources)
+		}
+	}
+}
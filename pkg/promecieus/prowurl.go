@@ -0,0 +1,258 @@
+package promecieus
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	prowJobPeriodic   = "periodic"
+	prowJobPostsubmit = "postsubmit"
+	prowJobPresubmit  = "presubmit"
+	prowJobBatch      = "batch"
+
+	logsPath         = "logs"
+	prLogsPath       = "pr-logs"
+	prPullPath       = "pull"
+	prDirectory      = "directory"
+	storageCloudHost = "storage.cloud.google.com"
+	defaultBucket    = "test-platform-results"
+)
+
+// ProwJob identifies a single Prow job run in the artifacts bucket
+type ProwJob struct {
+	Bucket string `json:"bucket"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	// BuildID is empty when URL points to job history
+	BuildID string `json:"buildID"`
+	Org     string `json:"org,omitempty"`
+	Repo    string `json:"repo,omitempty"`
+	PR      string `json:"pr,omitempty"`
+}
+
+// jobFromParams builds job identity from job name and build ID without any lookups.
+// Presubmit location is looked up via pr-logs/directory unless org, repo and pr are set
+func jobFromParams(params url.Values) (*ProwJob, error) {
+	job := &ProwJob{
+		Bucket:  params.Get("bucket"),
+		Name:    params.Get("job"),
+		BuildID: params.Get("build"),
+		Org:     params.Get("org"),
+		Repo:    params.Get("repo"),
+		PR:      params.Get("pr"),
+	}
+	if job.Name == "" {
+		return nil, fmt.Errorf("job name is required")
+	}
+	if job.BuildID != "" && !isBuildID(job.BuildID) {
+		return nil, fmt.Errorf("invalid build ID %q", job.BuildID)
+	}
+	if job.PR != "" && (!isBuildID(job.PR) || job.Repo == "") {
+		return nil, fmt.Errorf("pull request requires a number and a repo")
+	}
+	if job.Bucket == "" {
+		job.Bucket = defaultBucket
+	}
+	job.Type = jobTypeFromName(job.Name)
+	if strings.HasPrefix(job.Name, "pull-") {
+		job.Type = prowJobPresubmit
+	}
+	return job, nil
+}
+
+// URL returns gs:// link to the job run, which ParseProwURL understands
+func (j *ProwJob) URL() string {
+	if j.BuildID != "" && !j.knownPath() {
+		return fmt.Sprintf("gs://%s/%s/%s/%s/%s.txt", j.Bucket, prLogsPath, prDirectory, j.Name, j.BuildID)
+	}
+	return fmt.Sprintf("gs://%s/%s", j.Bucket, j.Path())
+}
+
+// knownPath reports whether job run location in the bucket can be built without a lookup.
+// Presubmits found via pr-logs/directory need to be looked up first
+func (j *ProwJob) knownPath() bool {
+	if j.BuildID == "" {
+		return false
+	}
+	return j.Type != prowJobPresubmit || j.PR != ""
+}
+
+// Path returns job run folder in the bucket, ending with a slash
+func (j *ProwJob) Path() string {
+	switch j.Type {
+	case prowJobPresubmit:
+		if j.PR == "" {
+			return fmt.Sprintf("%s/%s/%s/", prLogsPath, prDirectory, j.Name)
+		}
+		orgRepo := j.Repo
+		if j.Org != "" {
+			orgRepo = j.Org + "_" + j.Repo
+		}
+		return fmt.Sprintf("%s/%s/%s/%s/%s/%s/", prLogsPath, prPullPath, orgRepo, j.PR, j.Name, j.BuildID)
+	case prowJobBatch:
+		return fmt.Sprintf("%s/%s/%s/%s/%s/", prLogsPath, prPullPath, prowJobBatch, j.Name, j.BuildID)
+	default:
+		if j.BuildID == "" {
+			return fmt.Sprintf("%s/%s/", logsPath, j.Name)
+		}
+		return fmt.Sprintf("%s/%s/%s/", logsPath, j.Name, j.BuildID)
+	}
+}
+
+// jobFolder returns the folder which keeps all runs of the job and latest-build.txt
+func (j *ProwJob) jobFolder() string {
+	switch j.Type {
+	case prowJobPresubmit, prowJobBatch:
+		return fmt.Sprintf("%s/%s/%s/", prLogsPath, prDirectory, j.Name)
+	default:
+		return fmt.Sprintf("%s/%s/", logsPath, j.Name)
+	}
+}
+
+// ParseProwURL extracts job identity from deck, spyglass, job history, gcsweb and GCS links.
+// It doesn't make any network requests
+func ParseProwURL(u *url.URL) (*ProwJob, error) {
+	objectPath, err := gcsObjectPath(u)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a Prow job link", u)
+	}
+	if len(objectPath) < 2 {
+		return nil, fmt.Errorf("no job path found in %s", u)
+	}
+	job, err := parseJobPath(objectPath[1:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", u, err)
+	}
+	job.Bucket = objectPath[0]
+	return job, nil
+}
+
+// gcsObjectPath returns bucket name followed by object path segments for GCS, gcsweb and deck links
+func gcsObjectPath(u *url.URL) ([]string, error) {
+	segments := splitPath(u.Path)
+	switch {
+	case u.Scheme == "gs":
+		return append([]string{u.Host}, segments...), nil
+	case u.Host == strings.TrimPrefix(storagePrefix, "https://") || u.Host == storageCloudHost:
+		return segments, nil
+	case len(segments) > 0 && segments[0] == "gcs":
+		// gcsweb links
+		return segments[1:], nil
+	case len(segments) > 1 && (segments[0] == "view" || segments[0] == "job-history"):
+		// deck and spyglass links, storage provider is optional for job history
+		objectPath := segments[1:]
+		if objectPath[0] == "gs" || objectPath[0] == "gcs" {
+			objectPath = objectPath[1:]
+		}
+		return objectPath, nil
+	}
+	return nil, fmt.Errorf("%s is not a GCS link", u)
+}
+
+// parseJobPath parses job location in the bucket, extra segments after build ID are ignored
+func parseJobPath(segments []string) (*ProwJob, error) {
+	switch segments[0] {
+	case logsPath:
+		if len(segments) < 2 {
+			return nil, fmt.Errorf("no job name found")
+		}
+		job := &ProwJob{
+			Name: segments[1],
+			Type: jobTypeFromName(segments[1]),
+		}
+		if len(segments) > 2 {
+			if !isBuildID(segments[2]) {
+				return nil, fmt.Errorf("invalid build ID %q", segments[2])
+			}
+			job.BuildID = segments[2]
+		}
+		return job, nil
+	case prLogsPath:
+		if len(segments) < 3 {
+			return nil, fmt.Errorf("no job name found")
+		}
+		switch segments[1] {
+		case prDirectory:
+			// pr-logs/directory/<job>[/<build>.txt]
+			job := &ProwJob{
+				Name: segments[2],
+				Type: prowJobPresubmit,
+			}
+			if len(segments) > 3 {
+				buildID := strings.TrimSuffix(segments[3], ".txt")
+				if !isBuildID(buildID) {
+					return nil, fmt.Errorf("invalid build ID %q", segments[3])
+				}
+				job.BuildID = buildID
+			}
+			return job, nil
+		case prPullPath:
+			if segments[2] == prowJobBatch {
+				// pr-logs/pull/batch/<job>/<build>
+				if len(segments) < 5 || !isBuildID(segments[4]) {
+					return nil, fmt.Errorf("no build ID found for batch job")
+				}
+				return &ProwJob{
+					Name:    segments[3],
+					Type:    prowJobBatch,
+					BuildID: segments[4],
+				}, nil
+			}
+			// pr-logs/pull/<org>_<repo>/<pr>/<job>/<build>
+			if len(segments) < 6 {
+				return nil, fmt.Errorf("incomplete pull request job path")
+			}
+			if !isBuildID(segments[3]) {
+				return nil, fmt.Errorf("invalid pull request number %q", segments[3])
+			}
+			if !isBuildID(segments[5]) {
+				return nil, fmt.Errorf("invalid build ID %q", segments[5])
+			}
+			job := &ProwJob{
+				Type:    prowJobPresubmit,
+				PR:      segments[3],
+				Name:    segments[4],
+				BuildID: segments[5],
+			}
+			if org, repo, ok := strings.Cut(segments[2], "_"); ok {
+				job.Org, job.Repo = org, repo
+			} else {
+				job.Repo = segments[2]
+			}
+			return job, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown job path %s", strings.Join(segments, "/"))
+}
+
+// jobTypeFromName guesses type of jobs stored in logs/ using OpenShift CI naming conventions
+func jobTypeFromName(name string) string {
+	if strings.HasPrefix(name, "branch-") || strings.HasSuffix(name, "-postsubmit") {
+		return prowJobPostsubmit
+	}
+	return prowJobPeriodic
+}
+
+func isBuildID(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func splitPath(p string) []string {
+	segments := []string{}
+	for _, s := range strings.Split(p, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+	return segments
+}
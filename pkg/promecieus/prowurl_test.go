@@ -0,0 +1,188 @@
+package promecieus
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseProwURL(t *testing.T) {
+	periodic := &ProwJob{
+		Bucket:  "test-platform-results",
+		Type:    prowJobPeriodic,
+		Name:    "periodic-ci-openshift-release-master-nightly-4.16-e2e-aws-ovn",
+		BuildID: "1790000000000000000",
+	}
+	presubmit := &ProwJob{
+		Bucket:  "test-platform-results",
+		Type:    prowJobPresubmit,
+		Name:    "pull-ci-openshift-origin-master-e2e-aws-ovn",
+		BuildID: "1790000000000000001",
+		Org:     "openshift",
+		Repo:    "origin",
+		PR:      "28500",
+	}
+
+	for _, tc := range []struct {
+		name     string
+		url      string
+		expected *ProwJob
+		// knownPath is false for presubmits which location is looked up in pr-logs/directory
+		knownPath bool
+	}{
+		{
+			name:      "deck spyglass view",
+			url:       "https://prow.ci.openshift.org/view/gs/test-platform-results/logs/periodic-ci-openshift-release-master-nightly-4.16-e2e-aws-ovn/1790000000000000000",
+			expected:  periodic,
+			knownPath: true,
+		},
+		{
+			name:      "gcsweb folder",
+			url:       "https://gcsweb-ci.apps.ci.l2s4.p1.openshiftapps.com/gcs/test-platform-results/logs/periodic-ci-openshift-release-master-nightly-4.16-e2e-aws-ovn/1790000000000000000/",
+			expected:  periodic,
+			knownPath: true,
+		},
+		{
+			name:      "storage.googleapis.com artifact",
+			url:       "https://storage.googleapis.com/test-platform-results/logs/periodic-ci-openshift-release-master-nightly-4.16-e2e-aws-ovn/1790000000000000000/build-log.txt",
+			expected:  periodic,
+			knownPath: true,
+		},
+		{
+			name:      "storage.cloud.google.com artifact",
+			url:       "https://storage.cloud.google.com/test-platform-results/logs/periodic-ci-openshift-release-master-nightly-4.16-e2e-aws-ovn/1790000000000000000/artifacts/",
+			expected:  periodic,
+			knownPath: true,
+		},
+		{
+			name:      "gs link",
+			url:       "gs://test-platform-results/logs/periodic-ci-openshift-release-master-nightly-4.16-e2e-aws-ovn/1790000000000000000",
+			expected:  periodic,
+			knownPath: true,
+		},
+		{
+			name: "job history",
+			url:  "https://prow.ci.openshift.org/job-history/gs/test-platform-results/logs/periodic-ci-openshift-release-master-nightly-4.16-e2e-aws-ovn",
+			expected: &ProwJob{
+				Bucket: "test-platform-results",
+				Type:   prowJobPeriodic,
+				Name:   "periodic-ci-openshift-release-master-nightly-4.16-e2e-aws-ovn",
+			},
+		},
+		{
+			name: "job history of presubmit",
+			url:  "https://prow.ci.openshift.org/job-history/gs/test-platform-results/pr-logs/directory/pull-ci-openshift-origin-master-e2e-aws-ovn",
+			expected: &ProwJob{
+				Bucket: "test-platform-results",
+				Type:   prowJobPresubmit,
+				Name:   "pull-ci-openshift-origin-master-e2e-aws-ovn",
+			},
+		},
+		{
+			name: "postsubmit in logs",
+			url:  "https://prow.ci.openshift.org/view/gs/test-platform-results/logs/branch-ci-openshift-origin-master-images/1790000000000000002",
+			expected: &ProwJob{
+				Bucket:  "test-platform-results",
+				Type:    prowJobPostsubmit,
+				Name:    "branch-ci-openshift-origin-master-images",
+				BuildID: "1790000000000000002",
+			},
+			knownPath: true,
+		},
+		{
+			name:      "presubmit in pr-logs",
+			url:       "https://prow.ci.openshift.org/view/gs/test-platform-results/pr-logs/pull/openshift_origin/28500/pull-ci-openshift-origin-master-e2e-aws-ovn/1790000000000000001",
+			expected:  presubmit,
+			knownPath: true,
+		},
+		{
+			name: "presubmit of repo with underscore-less name",
+			url:  "gs://test-platform-results/pr-logs/pull/origin/28500/pull-ci-openshift-origin-master-e2e-aws-ovn/1790000000000000001",
+			expected: &ProwJob{
+				Bucket:  "test-platform-results",
+				Type:    prowJobPresubmit,
+				Name:    "pull-ci-openshift-origin-master-e2e-aws-ovn",
+				BuildID: "1790000000000000001",
+				Repo:    "origin",
+				PR:      "28500",
+			},
+			knownPath: true,
+		},
+		{
+			name: "batch job",
+			url:  "https://prow.ci.openshift.org/view/gs/test-platform-results/pr-logs/pull/batch/pull-ci-openshift-origin-master-e2e-aws-ovn/1790000000000000003",
+			expected: &ProwJob{
+				Bucket:  "test-platform-results",
+				Type:    prowJobBatch,
+				Name:    "pull-ci-openshift-origin-master-e2e-aws-ovn",
+				BuildID: "1790000000000000003",
+			},
+			knownPath: true,
+		},
+		{
+			name: "presubmit without PR via pr-logs/directory",
+			url:  "gs://test-platform-results/pr-logs/directory/pull-ci-openshift-origin-master-e2e-aws-ovn/1790000000000000001.txt",
+			expected: &ProwJob{
+				Bucket:  "test-platform-results",
+				Type:    prowJobPresubmit,
+				Name:    "pull-ci-openshift-origin-master-e2e-aws-ovn",
+				BuildID: "1790000000000000001",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			job, err := ParseProwURL(u)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(job, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, job)
+			}
+			if job.knownPath() != tc.knownPath {
+				t.Errorf("expected knownPath %v, got %v", tc.knownPath, job.knownPath())
+			}
+			// Links built for jobs are parsed back into the same job
+			jobURL, err := url.Parse(job.URL())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if roundTrip, err := ParseProwURL(jobURL); err != nil || !reflect.DeepEqual(roundTrip, job) {
+				t.Errorf("link %s parsed into %+v, %v", jobURL, roundTrip, err)
+			}
+		})
+	}
+}
+
+func TestParseProwURLErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		url  string
+	}{
+		{name: "not a GCS link", url: "https://github.com/openshift/origin/pull/28500"},
+		{name: "deck without job", url: "https://prow.ci.openshift.org/view/gs"},
+		{name: "bucket only", url: "gs://test-platform-results"},
+		{name: "unknown folder", url: "gs://test-platform-results/releases/4.16"},
+		{name: "logs without job", url: "gs://test-platform-results/logs"},
+		{name: "invalid build ID", url: "gs://test-platform-results/logs/periodic-ci-job/latest"},
+		{name: "incomplete pull request path", url: "gs://test-platform-results/pr-logs/pull/openshift_origin/28500"},
+		{name: "invalid pull request number", url: "gs://test-platform-results/pr-logs/pull/openshift_origin/abc/pull-ci-job/1790000000000000001"},
+		{name: "invalid presubmit build ID", url: "gs://test-platform-results/pr-logs/pull/openshift_origin/28500/pull-ci-job/latest"},
+		{name: "batch without build", url: "gs://test-platform-results/pr-logs/pull/batch/pull-ci-job"},
+		{name: "invalid directory build ID", url: "gs://test-platform-results/pr-logs/directory/pull-ci-job/latest-build.txt"},
+		{name: "unknown pr-logs folder", url: "gs://test-platform-results/pr-logs/other/pull-ci-job"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if job, err := ParseProwURL(u); err == nil {
+				t.Errorf("expected error, got %+v", job)
+			}
+		})
+	}
+}
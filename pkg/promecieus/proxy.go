@@ -0,0 +1,144 @@
+package promecieus
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const proxyPath = "/prom/"
+
+// proxyRoutePrefix is the path instance is served at, also passed to prometheus as --web.route-prefix
+func proxyRoutePrefix(appLabel string) string {
+	return proxyPath + appLabel
+}
+
+// proxyExposer serves instances under /prom/<label>/ of promecieus itself instead of creating
+// an object per instance, so instances are reachable as soon as pods are ready
+type proxyExposer struct {
+	exposureBase
+	namespace string
+	proxy     *httputil.ReverseProxy
+
+	sync.Mutex
+	lastAccess map[string]time.Time
+}
+
+func newProxyExposer(base exposureBase, namespace string) *proxyExposer {
+	p := &proxyExposer{
+		exposureBase: base,
+		namespace:    namespace,
+		lastAccess:   make(map[string]time.Time),
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			// Path is kept as is, prometheus serves it under the route prefix
+			r.SetURL(p.serviceURL(appLabelFromProxyPath(r.In.URL.Path)))
+			r.SetXForwarded()
+		},
+	}
+	return p
+}
+
+// appLabelFromProxyPath returns the label of /prom/<label>/... path
+func appLabelFromProxyPath(path string) string {
+	appLabel, _, _ := strings.Cut(strings.TrimPrefix(path, proxyPath), "/")
+	return appLabel
+}
+
+// validAppLabel checks that label was generated by promecieus, so that proxy can't be pointed to other hosts
+func validAppLabel(appLabel string) bool {
+	if len(appLabel) != randLength {
+		return false
+	}
+	for _, c := range appLabel {
+		if !strings.ContainsRune(charset, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceURL is the address of instance service inside the cluster
+func (p *proxyExposer) serviceURL(appLabel string) *url.URL {
+	return &url.URL{Scheme: "http", Host: fmt.Sprintf("%s.%s.svc:9090", appLabel, p.namespace)}
+}
+
+func (p *proxyExposer) Name() string {
+	return exposureProxy
+}
+
+func (p *proxyExposer) Template() string {
+	return ""
+}
+
+func (p *proxyExposer) Configure(params *manifestParams) error {
+	if err := p.exposureBase.Configure(params); err != nil {
+		return err
+	}
+	params.RoutePrefix = proxyRoutePrefix(params.AppLabel)
+	params.ExternalURL = p.instanceURL(params.AppLabel)
+	return nil
+}
+
+func (p *proxyExposer) instanceURL(appLabel string) string {
+	return strings.TrimSuffix(p.settings.PublicURL, "/") + proxyRoutePrefix(appLabel)
+}
+
+func (p *proxyExposer) Create(ctx context.Context, appLabel string, obj metav1.Object) (string, error) {
+	return p.instanceURL(appLabel), nil
+}
+
+// ProbeURL checks the service directly, skipping the public ingress of promecieus
+func (p *proxyExposer) ProbeURL(appLabel, instanceURL string) string {
+	return p.serviceURL(appLabel).String() + proxyRoutePrefix(appLabel)
+}
+
+func (p *proxyExposer) Remove(ctx context.Context, appLabel string) ([]string, error) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.lastAccess, appLabel)
+	return nil, nil
+}
+
+func (p *proxyExposer) access(appLabel string) {
+	p.Lock()
+	defer p.Unlock()
+	p.lastAccess[appLabel] = time.Now()
+}
+
+// LastAccess returns the time instance was last requested via proxy, zero if it never was
+func (p *proxyExposer) LastAccess(appLabel string) time.Time {
+	p.Lock()
+	defer p.Unlock()
+	return p.lastAccess[appLabel]
+}
+
+// HandleProxy forwards /prom/<label>/ requests to the instance service
+func (s *ServerSettings) HandleProxy(c *gin.Context) {
+	proxy, ok := s.Exposer.(*proxyExposer)
+	if !ok {
+		c.String(http.StatusNotFound, "instances are not exposed via promecieus proxy")
+		return
+	}
+	appLabel := c.Param("label")
+	if !validAppLabel(appLabel) {
+		c.String(http.StatusNotFound, fmt.Sprintf("unknown instance %q", appLabel))
+		return
+	}
+	// Queries over large archives may run longer than server write timeout
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	proxy.access(appLabel)
+	proxy.proxy.ServeHTTP(c.Writer, c.Request)
+}
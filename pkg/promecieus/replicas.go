@@ -0,0 +1,99 @@
+package promecieus
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// replicasParam selects how prometheus-k8s replica snapshots are used
+	replicasParam = "replicas"
+	// replicasBest picks the snapshot which covers longer time range
+	replicasBest = "best"
+)
+
+// replicaName returns prometheus pod name the snapshot was taken from
+func replicaName(archiveURL string) string {
+	if strings.HasSuffix(archiveURL, path.Base(prom2ndTarPath)) {
+		return "prometheus-k8s-1"
+	}
+	return "prometheus-k8s-0"
+}
+
+// siblingReplicaURL returns URL of the other replica snapshot stored next to the archive
+func siblingReplicaURL(archiveURL string) string {
+	if strings.HasSuffix(archiveURL, prom2ndTarPath) {
+		return strings.TrimSuffix(archiveURL, prom2ndTarPath) + promTarPath
+	}
+	if strings.HasSuffix(archiveURL, promTarPath) {
+		return strings.TrimSuffix(archiveURL, promTarPath) + prom2ndTarPath
+	}
+	return ""
+}
+
+// pickReplica decides which replica snapshots are loaded according to the URL params
+func (s *ServerSettings) pickReplica(ctx context.Context, conn *websocket.Conn, u *url.URL, prowInfo *ProwInfo) error {
+	mode := u.Query().Get(replicasParam)
+	if u.Query().Has("altsnap") {
+		if prowInfo.ReplicaURL == "" {
+			return fmt.Errorf("second prometheus snapshot not found")
+		}
+		prowInfo.MetricsURL, prowInfo.ReplicaURL = prowInfo.ReplicaURL, prowInfo.MetricsURL
+		prowInfo.Size, prowInfo.ReplicaSize = prowInfo.ReplicaSize, prowInfo.Size
+		return nil
+	}
+	if mode == "" {
+		return nil
+	}
+	if mode != replicasBest {
+		return fmt.Errorf("unknown replicas mode %q, expected %q", mode, replicasBest)
+	}
+	if prowInfo.ReplicaURL == "" {
+		sendWSMessage(conn, "status", "Only one prometheus snapshot found, using it")
+		return nil
+	}
+	replicaHead, err := s.Fetcher.checkArchive(ctx, prowInfo.ReplicaURL)
+	if err != nil {
+		sendWSMessage(conn, "status", fmt.Sprintf("Second prometheus snapshot is not available, using %s: %v", replicaName(prowInfo.MetricsURL), err))
+		prowInfo.ReplicaURL, prowInfo.ReplicaSize = "", 0
+		return nil
+	}
+
+	sendWSMessage(conn, "status", "Comparing time ranges of both prometheus snapshots")
+	primaryHead, err := s.Fetcher.checkArchive(ctx, prowInfo.MetricsURL)
+	if err != nil {
+		return err
+	}
+	primary, err := s.Fetcher.readArchiveContents(ctx, prowInfo.MetricsURL, primaryHead)
+	if err != nil {
+		return fmt.Errorf("failed to read blocks of %s: %v", prowInfo.MetricsURL, err)
+	}
+	replica, err := s.Fetcher.readArchiveContents(ctx, prowInfo.ReplicaURL, replicaHead)
+	if err != nil {
+		return fmt.Errorf("failed to read blocks of %s: %v", prowInfo.ReplicaURL, err)
+	}
+	primarySummary, replicaSummary := summarizeBlocks(primary.Blocks), summarizeBlocks(replica.Blocks)
+	sendWSMessage(conn, "status", fmt.Sprintf("%s: %s", replicaName(prowInfo.MetricsURL), primarySummary))
+	sendWSMessage(conn, "status", fmt.Sprintf("%s: %s", replicaName(prowInfo.ReplicaURL), replicaSummary))
+
+	switch {
+	case replicaSummary.Covered > primarySummary.Covered:
+		sendWSMessage(conn, "status", fmt.Sprintf("Using %s snapshot as it covers longer time range", replicaName(prowInfo.ReplicaURL)))
+	case replicaSummary.Covered == primarySummary.Covered && replicaSummary.NumSamples > primarySummary.NumSamples:
+		sendWSMessage(conn, "status", fmt.Sprintf("Using %s snapshot as both cover the same time range and it has more samples", replicaName(prowInfo.ReplicaURL)))
+	case replicaSummary.Covered == primarySummary.Covered && replicaSummary.NumSamples == primarySummary.NumSamples:
+		sendWSMessage(conn, "status", fmt.Sprintf("Both snapshots have the same coverage, using default %s snapshot", replicaName(prowInfo.MetricsURL)))
+		return nil
+	default:
+		sendWSMessage(conn, "status", fmt.Sprintf("Using %s snapshot as it has better coverage", replicaName(prowInfo.MetricsURL)))
+		return nil
+	}
+	prowInfo.MetricsURL, prowInfo.ReplicaURL = prowInfo.ReplicaURL, prowInfo.MetricsURL
+	prowInfo.Size, prowInfo.ReplicaSize = prowInfo.ReplicaSize, prowInfo.Size
+	return nil
+}
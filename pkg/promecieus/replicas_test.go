@@ -0,0 +1,137 @@
+package promecieus
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockULIDs are valid block directory names used in test archives
+var blockULIDs = []string{"01HXYZ0000000000000000ABCD", "01HXYZ0000000000000000ABCE", "01HXYZ0000000000000000ABCF"}
+
+// tsdbTar builds a plain tar archive of TSDB blocks with the specified time ranges and sample counts
+func tsdbTar(t *testing.T, blocks ...blockMeta) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for i, block := range blocks {
+		block.ULID = blockULIDs[i]
+		meta, err := json.Marshal(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, content := range map[string][]byte{blockMetaFile: meta, blockIndexFile: []byte("index")} {
+			if err := tw.WriteHeader(&tar.Header{Name: block.ULID + "/" + name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write(content); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func testBlock(minTime, maxTime time.Time, samples uint64) blockMeta {
+	b := blockMeta{MinTime: minTime.UnixMilli(), MaxTime: maxTime.UnixMilli()}
+	b.Stats.NumSamples = samples
+	return b
+}
+
+// archiveServer serves archives by path, supporting HEAD and range requests
+func archiveServer(archives map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		archive, ok := archives[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "prometheus.tar", time.Time{}, bytes.NewReader(archive))
+	}))
+}
+
+func TestPickReplicaBest(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name            string
+		primary         []blockMeta
+		replica         []blockMeta
+		expectedURL     string
+		expectedMessage string
+	}{
+		{
+			name:            "replica covers longer range",
+			primary:         []blockMeta{testBlock(start, start.Add(time.Hour), 100)},
+			replica:         []blockMeta{testBlock(start, start.Add(2*time.Hour), 100)},
+			expectedURL:     "/" + prom2ndTarPath,
+			expectedMessage: "Using prometheus-k8s-1 snapshot as it covers longer time range",
+		},
+		{
+			name:            "same range, replica has more samples",
+			primary:         []blockMeta{testBlock(start, start.Add(time.Hour), 100)},
+			replica:         []blockMeta{testBlock(start, start.Add(time.Hour), 200)},
+			expectedURL:     "/" + prom2ndTarPath,
+			expectedMessage: "Using prometheus-k8s-1 snapshot as both cover the same time range and it has more samples",
+		},
+		{
+			name:            "tie",
+			primary:         []blockMeta{testBlock(start, start.Add(time.Hour), 100)},
+			replica:         []blockMeta{testBlock(start, start.Add(time.Hour), 100)},
+			expectedURL:     "/" + promTarPath,
+			expectedMessage: "Both snapshots have the same coverage, using default prometheus-k8s-0 snapshot",
+		},
+		{
+			name:            "primary covers longer range",
+			primary:         []blockMeta{testBlock(start, start.Add(2*time.Hour), 100)},
+			replica:         []blockMeta{testBlock(start, start.Add(time.Hour), 200)},
+			expectedURL:     "/" + promTarPath,
+			expectedMessage: "Using prometheus-k8s-0 snapshot as it has better coverage",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := archiveServer(map[string][]byte{
+				"/" + promTarPath:    tsdbTar(t, tc.primary...),
+				"/" + prom2ndTarPath: tsdbTar(t, tc.replica...),
+			})
+			defer server.Close()
+			conn, messages := wsPair(t)
+			s := &ServerSettings{Fetcher: testFetcher()}
+
+			prowInfo := &ProwInfo{MetricsURL: server.URL + "/" + promTarPath, ReplicaURL: server.URL + "/" + prom2ndTarPath}
+			u, _ := url.Parse("https://prow.ci.openshift.org/view/gs/bucket/logs/job/1?replicas=best")
+			if err := s.pickReplica(context.Background(), conn, u, prowInfo); err != nil {
+				t.Fatal(err)
+			}
+			if prowInfo.MetricsURL != server.URL+tc.expectedURL {
+				t.Errorf("expected %s to be used, got %s", tc.expectedURL, prowInfo.MetricsURL)
+			}
+			for {
+				m := nextMessage(t, messages, "status")
+				if strings.HasPrefix(m.Message, "Using") || strings.HasPrefix(m.Message, "Both") {
+					if m.Message != tc.expectedMessage {
+						t.Errorf("expected %q, got %q", tc.expectedMessage, m.Message)
+					}
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestPickReplicaUnknownMode(t *testing.T) {
+	s := &ServerSettings{Fetcher: testFetcher()}
+	u, _ := url.Parse("https://prow.ci.openshift.org/view/gs/bucket/logs/job/1?replicas=merge")
+	if err := s.pickReplica(context.Background(), nil, u, &ProwInfo{MetricsURL: "https://example.com/" + promTarPath}); err == nil {
+		t.Error("expected merge mode to be refused")
+	}
+}
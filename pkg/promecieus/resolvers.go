@@ -0,0 +1,84 @@
+package promecieus
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ArtifactResolver finds a prometheus archive for a user-supplied URL
+type ArtifactResolver interface {
+	// Name is a short resolver description used in status messages
+	Name() string
+	// Match reports whether this resolver can handle the URL
+	Match(u *url.URL) bool
+	// Resolve finds the metrics archive and the time range of the test
+	Resolve(ctx context.Context, u *url.URL) (ProwInfo, error)
+}
+
+// ResolverRegistry keeps an ordered list of artifact resolvers.
+// The first resolver which matches the URL is used.
+type ResolverRegistry struct {
+	resolvers []ArtifactResolver
+}
+
+// NewResolverRegistry creates a registry with resolvers in the specified order
+func NewResolverRegistry(resolvers ...ArtifactResolver) *ResolverRegistry {
+	return &ResolverRegistry{resolvers: resolvers}
+}
+
+// DefaultResolvers returns a registry with all built-in resolvers
+func DefaultResolvers(fetcher *Fetcher) *ResolverRegistry {
+	return NewResolverRegistry(
+		&directTarResolver{},
+		&mustGatherResolver{fetcher: fetcher, lister: newGCSLister(fetcher), dirs: &httpDirStore{fetcher: fetcher}},
+		&prowResolver{fetcher: fetcher, lister: newGCSLister(fetcher)},
+		&directoryResolver{name: "http directory", store: &httpDirStore{fetcher: fetcher}, locate: locateHTTPDir},
+	)
+}
+
+// Register appends a resolver to the registry. It should be called before the server starts
+func (r *ResolverRegistry) Register(resolver ArtifactResolver) {
+	r.resolvers = append(r.resolvers, resolver)
+}
+
+// Find returns first resolver which can handle the URL
+func (r *ResolverRegistry) Find(u *url.URL) (ArtifactResolver, error) {
+	for _, resolver := range r.resolvers {
+		if resolver.Match(u) {
+			return resolver, nil
+		}
+	}
+	return nil, fmt.Errorf("no resolver found for %s", u)
+}
+
+// directTarResolver handles direct links to prometheus tarballs
+type directTarResolver struct{}
+
+func (d *directTarResolver) Name() string {
+	return "direct tarball"
+}
+
+func (d *directTarResolver) Match(u *url.URL) bool {
+	return isHTTPURL(u) && (strings.HasSuffix(u.Path, promTarPath) || strings.HasSuffix(u.Path, prom2ndTarPath))
+}
+
+// isHTTPURL checks if the link can be fetched as is. Other schemes are handled by storage specific resolvers
+func isHTTPURL(u *url.URL) bool {
+	return u.Scheme == "http" || u.Scheme == "https"
+}
+
+func (d *directTarResolver) Resolve(ctx context.Context, u *url.URL) (ProwInfo, error) {
+	prowInfo := ProwInfo{}
+	// Drop promecieus params and make it a fetchable URL if it's a gcsweb URL
+	archiveURL := *u
+	archiveURL.RawQuery = ""
+	prowInfo.MetricsURL = strings.Replace(archiveURL.String(), gcsPrefix+"/gcs", storagePrefix, -1)
+	prowInfo.ReplicaURL = siblingReplicaURL(prowInfo.MetricsURL)
+	// there is no way to find out the time via direct tarball link, use current time
+	prowInfo.Finished = time.Now()
+	prowInfo.Started = time.Now()
+	return prowInfo, nil
+}
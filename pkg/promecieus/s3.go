@@ -0,0 +1,251 @@
+package promecieus
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultS3Endpoint = "https://s3.amazonaws.com"
+	defaultS3Region   = "us-east-1"
+	// s3LinkExpiration is the validity of presigned links, init container has to start downloading before it
+	s3LinkExpiration = 6 * time.Hour
+)
+
+// S3Settings configures access to S3-compatible storage, like AWS S3 or MinIO.
+// Buckets are accessed anonymously when no keys are set
+type S3Settings struct {
+	Endpoint        string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// S3SettingsFromSecret reads endpoint, region and credentials from the secret.
+// Keys missing in the secret keep values set in the settings
+func S3SettingsFromSecret(ctx context.Context, k8sC *k8s.Clientset, namespace, name string, settings S3Settings) (S3Settings, error) {
+	secret, err := k8sC.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return settings, fmt.Errorf("failed to read S3 credentials from secret %s: %v", name, err)
+	}
+	for key, field := range map[string]*string{
+		"endpoint":          &settings.Endpoint,
+		"region":            &settings.Region,
+		"access_key_id":     &settings.AccessKeyID,
+		"secret_access_key": &settings.SecretAccessKey,
+	} {
+		if value, ok := secret.Data[key]; ok {
+			*field = strings.TrimSpace(string(value))
+		}
+	}
+	return settings, nil
+}
+
+// NewS3Resolver creates a resolver for s3://bucket/prefix links
+func NewS3Resolver(fetcher *Fetcher, settings S3Settings) ArtifactResolver {
+	if settings.Endpoint == "" {
+		settings.Endpoint = defaultS3Endpoint
+	}
+	if settings.Region == "" {
+		settings.Region = defaultS3Region
+	}
+	return &directoryResolver{
+		name:   "s3",
+		store:  &s3Store{fetcher: fetcher, settings: settings},
+		locate: locateS3,
+	}
+}
+
+// locateS3 handles s3://bucket/prefix links
+func locateS3(u *url.URL) (string, string, bool) {
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", false
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), true
+}
+
+// s3Store lists buckets using ListObjectsV2 API with path-style requests
+type s3Store struct {
+	fetcher  *Fetcher
+	settings S3Settings
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Store) List(ctx context.Context, bucket, prefix string) (*gcsListing, error) {
+	listing := &gcsListing{}
+	token := ""
+	for {
+		params := url.Values{}
+		params.Set("list-type", "2")
+		params.Set("prefix", prefix)
+		params.Set("delimiter", "/")
+		if token != "" {
+			params.Set("continuation-token", token)
+		}
+		listURL := s.signedURL(bucket, "", params)
+
+		resp, err := s.fetcher.Get(ctx, listURL)
+		if err != nil {
+			return nil, err
+		}
+		var page s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to list s3://%s/%s: returned %s", bucket, prefix, resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal listing of s3://%s/%s: %v", bucket, prefix, err)
+		}
+
+		for _, p := range page.CommonPrefixes {
+			listing.Prefixes = append(listing.Prefixes, p.Prefix)
+		}
+		for _, obj := range page.Contents {
+			listing.Objects = append(listing.Objects, gcsObject{
+				Name:    obj.Key,
+				Size:    obj.Size,
+				Updated: obj.LastModified,
+			})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return listing, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// ObjectURL returns a link which can be fetched without credentials
+func (s *s3Store) ObjectURL(bucket, name string) string {
+	return s.signedURL(bucket, name, url.Values{})
+}
+
+// signedURL builds a path-style link, presigned with AWS Signature Version 4 when credentials are set
+func (s *s3Store) signedURL(bucket, key string, params url.Values) string {
+	endpoint, err := url.Parse(s.settings.Endpoint)
+	if err != nil {
+		endpoint = &url.URL{Scheme: "https", Host: s.settings.Endpoint}
+	}
+	canonicalURI := strings.TrimSuffix(endpoint.Path, "/") + "/" + awsURIEncode(bucket, true)
+	if key != "" {
+		canonicalURI += "/" + awsURIEncode(key, false)
+	}
+	if s.settings.AccessKeyID == "" {
+		return fmt.Sprintf("%s://%s%s%s", endpoint.Scheme, endpoint.Host, canonicalURI, awsQuery(params))
+	}
+
+	return s.presign(endpoint, canonicalURI, params, time.Now(), s3LinkExpiration)
+}
+
+// presign adds AWS Signature Version 4 query params, only host header is signed
+func (s *s3Store) presign(endpoint *url.URL, canonicalURI string, params url.Values, now time.Time, expires time.Duration) string {
+	now = now.UTC()
+	date := now.Format("20060102")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.settings.Region)
+	params.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	params.Set("X-Amz-Credential", s.settings.AccessKeyID+"/"+scope)
+	params.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	params.Set("X-Amz-Expires", fmt.Sprintf("%d", int(expires.Seconds())))
+	params.Set("X-Amz-SignedHeaders", "host")
+	query := strings.TrimPrefix(awsQuery(params), "?")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		canonicalURI,
+		query,
+		"host:" + endpoint.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		params.Get("X-Amz-Date"),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	signingKey := []byte("AWS4" + s.settings.SecretAccessKey)
+	for _, part := range []string{date, s.settings.Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	return fmt.Sprintf("%s://%s%s?%s&X-Amz-Signature=%s", endpoint.Scheme, endpoint.Host, canonicalURI, query, signature)
+}
+
+// presignedQuery matches query strings of presigned links, which grant access to the object
+var presignedQuery = regexp.MustCompile(`\?[^\s"'?]*X-Amz-Signature=[0-9a-fA-F]+(?:(?:&|\\u0026)[\w%.~=-]*)*`)
+
+// isPresignedURL checks if the link carries AWS Signature Version 4 credentials
+func isPresignedURL(rawURL string) bool {
+	return presignedQuery.MatchString(rawURL)
+}
+
+// redactPresigned removes presigned query strings from the text, so that links can be shown to the user
+func redactPresigned(text string) string {
+	return presignedQuery.ReplaceAllString(text, "")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsQuery encodes params sorted by name, as required for signing
+func awsQuery(params url.Values) string {
+	if len(params) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, awsURIEncode(key, true)+"="+awsURIEncode(params.Get(key), true))
+	}
+	return "?" + strings.Join(pairs, "&")
+}
+
+// awsURIEncode escapes everything but unreserved characters. Slashes are kept in object keys
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
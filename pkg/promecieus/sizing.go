@@ -0,0 +1,164 @@
+package promecieus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+)
+
+const sizingRules = "sizing.yaml"
+
+// SizingRule maps unpacked archive size and the number of series to instance resources
+type SizingRule struct {
+	// MaxSize is the largest unpacked archive size the rule applies to, any size matches if unset
+	MaxSize *resource.Quantity `json:"maxSize,omitempty"`
+	// MaxSeries is the largest number of series in a single block, any number matches if unset
+	MaxSeries uint64                      `json:"maxSeries,omitempty"`
+	Resources corev1.ResourceRequirements `json:"resources"`
+	// Storage is the size limit of prometheus data volume, unbounded if unset
+	Storage *resource.Quantity `json:"storage,omitempty"`
+}
+
+func (r *SizingRule) matches(dataSize int64, series uint64) bool {
+	if r.MaxSize != nil && dataSize > r.MaxSize.Value() {
+		return false
+	}
+	return r.MaxSeries == 0 || series <= r.MaxSeries
+}
+
+// InstanceSizing is resources picked for the instance
+type InstanceSizing struct {
+	DataSize  int64                       `json:"dataSize"`
+	Series    uint64                      `json:"series"`
+	Resources corev1.ResourceRequirements `json:"resources"`
+	Storage   *resource.Quantity          `json:"storage,omitempty"`
+}
+
+func (i *InstanceSizing) String() string {
+	summary := fmt.Sprintf("requests %s, limits %s", formatResources(i.Resources.Requests), formatResources(i.Resources.Limits))
+	if i.Storage != nil {
+		summary += fmt.Sprintf(", storage limit %s", i.Storage)
+	}
+	return summary
+}
+
+// emptyDir returns prometheus data volume with the storage limit
+func (i *InstanceSizing) emptyDir() corev1.EmptyDirVolumeSource {
+	return corev1.EmptyDirVolumeSource{SizeLimit: i.Storage}
+}
+
+func formatResources(resources corev1.ResourceList) string {
+	if len(resources) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		q := resources[corev1.ResourceName(name)]
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, q.String()))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// parseSizingRules reads rules from the ConfigMap data, falling back to embedded defaults
+func parseSizingRules(data map[string]string) ([]SizingRule, error) {
+	text, ok := data[sizingRules]
+	if !ok {
+		defaultText, err := defaultTemplates.ReadFile("templates/" + sizingRules)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read default %s: %v", sizingRules, err)
+		}
+		text = string(defaultText)
+	}
+	var rules []SizingRule
+	if err := yaml.UnmarshalStrict([]byte(text), &rules); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", sizingRules, err)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("invalid %s: at least one rule is required", sizingRules)
+	}
+	return rules, nil
+}
+
+// pickSizing returns resources of the first rule matching the archive
+func pickSizing(rules []SizingRule, dataSize int64, series uint64) (*InstanceSizing, error) {
+	for _, rule := range rules {
+		if rule.matches(dataSize, series) {
+			return &InstanceSizing{
+				DataSize:  dataSize,
+				Series:    series,
+				Resources: rule.Resources,
+				Storage:   rule.Storage,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("archive with %s of data and %d series is too large, no sizing rule allows it",
+		resource.NewQuantity(dataSize, resource.BinarySI), series)
+}
+
+// sizeInstance picks resources for unpacked size and series of the instance archives
+func (s *ServerSettings) sizeInstance(conn *websocket.Conn, prowInfo *ProwInfo, contents map[string]*archiveContents) error {
+	var dataSize int64
+	var series uint64
+	partial := false
+	for _, archive := range prowInfo.archives() {
+		c, ok := contents[archive.URL]
+		if !ok {
+			continue
+		}
+		dataSize += c.unpackedSize()
+		series = max(series, c.maxSeries())
+		partial = partial || c.Partial
+	}
+	sizing, err := pickSizing(s.Templates.sizingRules(), dataSize, series)
+	if err != nil {
+		return err
+	}
+	prowInfo.Sizing = sizing
+	estimate := ""
+	if partial {
+		estimate = fmt.Sprintf(" (estimated from the first %dMiB of archive)", tsdbStreamLimit/1024/1024)
+	}
+	sendWSMessage(conn, "status", fmt.Sprintf("Sizing instance for %s of data and %d series%s: %s",
+		resource.NewQuantity(dataSize, resource.BinarySI), series, estimate, sizing))
+	return nil
+}
+
+// checkQuota refuses instances which would not fit into the namespace quota even if it was unused
+func (s *ServerSettings) checkQuota(sizings ...*InstanceSizing) error {
+	if s.RQStatus == nil || len(s.RQStatus.HardResources) == 0 {
+		return nil
+	}
+	total := map[corev1.ResourceName]*resource.Quantity{}
+	addUsage := func(name corev1.ResourceName, q resource.Quantity) {
+		if total[name] == nil {
+			total[name] = resource.NewQuantity(0, q.Format)
+		}
+		total[name].Add(q)
+	}
+	for _, sizing := range sizings {
+		for name, q := range sizing.Resources.Requests {
+			addUsage("requests."+name, q)
+			addUsage(name, q)
+		}
+		for name, q := range sizing.Resources.Limits {
+			addUsage("limits."+name, q)
+		}
+	}
+	for name, used := range total {
+		hard, ok := s.RQStatus.HardResources[name]
+		if ok && used.Cmp(hard) > 0 {
+			return fmt.Errorf("instance needs %s %s, but %s quota allows only %s", used, name, s.RQuotaName, hard.String())
+		}
+	}
+	return nil
+}
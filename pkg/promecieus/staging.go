@@ -0,0 +1,413 @@
+package promecieus
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog/v2"
+)
+
+const (
+	stagingPath      = "/staging/"
+	uploadFormField  = "archive"
+	uploadTimeout    = time.Hour
+	stagingFileName  = "prometheus.tar"
+	stagingTokenSize = 16
+)
+
+var errStagingFull = errors.New("staging area is full")
+
+// stagedFile is an uploaded archive waiting to be fetched by the instance
+type stagedFile struct {
+	path    string
+	size    int64
+	expires time.Time
+}
+
+// stagedStream is an archive which is built while the init container fetches it.
+// It is either a source archive, decompressed if format is set, or files of unpacked data directory
+type stagedStream struct {
+	source  string
+	format  ArchiveFormat
+	files   []ArchiveFile
+	expires time.Time
+}
+
+// Staging keeps uploaded archives on disk and serves them to the init containers.
+// Total size of staged files is limited and files are removed once they expire
+type Staging struct {
+	sync.Mutex
+	// Dir is a directory where archives are stored
+	Dir string
+	// SizeLimit is the maximum total size of staged archives in bytes
+	SizeLimit int64
+	// TTL is how long an archive can be fetched after the upload
+	TTL time.Duration
+	// InternalURL is promecieus service URL reachable from prometheus pods
+	InternalURL string
+
+	used    int64
+	files   map[string]*stagedFile
+	streams map[string]*stagedStream
+}
+
+// reserve accounts for the archive size, so that concurrent uploads won't exceed the limit
+func (s *Staging) reserve(size int64) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.used+size > s.SizeLimit {
+		return fmt.Errorf("%w: %d of %d bytes used", errStagingFull, s.used, s.SizeLimit)
+	}
+	s.used += size
+	return nil
+}
+
+func (s *Staging) release(size int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.used -= size
+}
+
+func newStagingToken() (string, error) {
+	tokenBytes := make([]byte, stagingTokenSize)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	return hex.EncodeToString(tokenBytes), nil
+}
+
+// Store saves the archive and returns a token it can be fetched with
+func (s *Staging) Store(r io.Reader) (string, error) {
+	token, err := newStagingToken()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create staging dir: %v", err)
+	}
+	filePath := filepath.Join(s.Dir, token)
+	f, err := os.Create(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging file: %v", err)
+	}
+	defer f.Close()
+
+	// Space is reserved in chunks while the upload is being written
+	var size int64
+	chunk := make([]byte, 1024*1024)
+	for {
+		n, readErr := r.Read(chunk)
+		if n > 0 {
+			if err := s.reserve(int64(n)); err != nil {
+				s.release(size)
+				os.Remove(filePath)
+				return "", err
+			}
+			size += int64(n)
+			if _, err := f.Write(chunk[:n]); err != nil {
+				s.release(size)
+				os.Remove(filePath)
+				return "", fmt.Errorf("failed to write staging file: %v", err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			s.release(size)
+			os.Remove(filePath)
+			return "", fmt.Errorf("failed to read upload: %v", readErr)
+		}
+	}
+	if size == 0 {
+		os.Remove(filePath)
+		return "", fmt.Errorf("uploaded archive is empty")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.files == nil {
+		s.files = make(map[string]*stagedFile)
+	}
+	s.files[token] = &stagedFile{path: filePath, size: size, expires: time.Now().Add(s.TTL)}
+	klog.Infof("Staged %d bytes as %s", size, token)
+	return token, nil
+}
+
+// Decompress returns a token which serves the compressed source archive as plain tar.
+// Nothing is stored on disk, the source is decompressed while being fetched
+func (s *Staging) Decompress(source string, format ArchiveFormat) (string, error) {
+	return s.addStream(&stagedStream{source: source, format: format})
+}
+
+// Proxy returns a token which serves the source archive as is.
+// It keeps presigned links out of the instance manifests
+func (s *Staging) Proxy(source string) (string, error) {
+	return s.addStream(&stagedStream{source: source})
+}
+
+// Bundle returns a token which serves the files as plain tar, fetching them one by one
+func (s *Staging) Bundle(files []ArchiveFile) (string, error) {
+	return s.addStream(&stagedStream{files: files})
+}
+
+func (s *Staging) addStream(stream *stagedStream) (string, error) {
+	token, err := newStagingToken()
+	if err != nil {
+		return "", err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.streams == nil {
+		s.streams = make(map[string]*stagedStream)
+	}
+	// Streams take no disk space, so they are kept until presigned links they proxy expire
+	stream.expires = time.Now().Add(max(s.TTL, s3LinkExpiration))
+	s.streams[token] = stream
+	return token, nil
+}
+
+// URL returns the link which init containers use to fetch the archive
+func (s *Staging) URL(token string) string {
+	return strings.TrimSuffix(s.InternalURL, "/") + stagingPath + token + "/" + stagingFileName
+}
+
+// lookup returns the staged file if it has not expired yet
+func (s *Staging) lookup(token string) (*stagedFile, bool) {
+	s.Lock()
+	defer s.Unlock()
+	file, ok := s.files[token]
+	if !ok || time.Now().After(file.expires) {
+		return nil, false
+	}
+	return file, true
+}
+
+// lookupStream returns the decompressed archive source if it has not expired yet
+func (s *Staging) lookupStream(token string) (*stagedStream, bool) {
+	s.Lock()
+	defer s.Unlock()
+	stream, ok := s.streams[token]
+	if !ok || time.Now().After(stream.expires) {
+		return nil, false
+	}
+	return stream, true
+}
+
+// Cleanup removes expired archives
+func (s *Staging) Cleanup() {
+	s.Lock()
+	defer s.Unlock()
+	for token, file := range s.files {
+		if time.Now().Before(file.expires) {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+			klog.Warningf("Failed to remove staged file %s: %v", file.path, err)
+			continue
+		}
+		s.used -= file.size
+		delete(s.files, token)
+		klog.Infof("Removed expired staged file %s", token)
+	}
+	for token, stream := range s.streams {
+		if time.Now().After(stream.expires) {
+			delete(s.streams, token)
+		}
+	}
+}
+
+// Name, Match and Resolve make staged archives available to the resolver registry
+func (s *Staging) Name() string {
+	return "upload"
+}
+
+func (s *Staging) Match(u *url.URL) bool {
+	return strings.HasPrefix(u.String(), strings.TrimSuffix(s.InternalURL, "/")+stagingPath)
+}
+
+func (s *Staging) Resolve(ctx context.Context, u *url.URL) (ProwInfo, error) {
+	token := strings.Split(strings.TrimPrefix(u.Path, stagingPath), "/")[0]
+	if _, ok := s.lookup(token); !ok {
+		return ProwInfo{}, fmt.Errorf("uploaded archive %s not found or expired", token)
+	}
+	// Time range is read from the blocks later
+	return ProwInfo{
+		MetricsURL: s.URL(token),
+		Started:    time.Now(),
+		Finished:   time.Now(),
+	}, nil
+}
+
+// HandleUpload stores archive from multipart form and returns its internal URL
+func (s *ServerSettings) HandleUpload(c *gin.Context) {
+	// Uploads take longer than the server read timeout
+	if err := http.NewResponseController(c.Writer).SetReadDeadline(time.Now().Add(uploadTimeout)); err != nil {
+		klog.Warningf("Failed to extend upload deadline: %v", err)
+	}
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s form field is required", uploadFormField)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if part.FormName() != uploadFormField {
+			continue
+		}
+		token, err := s.Staging.Store(part)
+		if errors.Is(err, errStagingFull) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"url": s.Staging.URL(token)})
+		return
+	}
+}
+
+// HandleStaged serves uploaded or decompressed archive to the init container
+func (s *ServerSettings) HandleStaged(c *gin.Context) {
+	file, fileOK := s.Staging.lookup(c.Param("token"))
+	stream, streamOK := s.Staging.lookupStream(c.Param("token"))
+	if !fileOK && !streamOK {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	// Large archives take longer than the server write timeout
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(uploadTimeout)); err != nil {
+		klog.Warningf("Failed to extend download deadline: %v", err)
+	}
+	switch {
+	case fileOK:
+		c.File(file.path)
+	case len(stream.files) > 0:
+		s.serveBundle(c, stream.files)
+	default:
+		s.serveStream(c, stream)
+	}
+}
+
+// serveStream fetches the source archive and writes it decompressed, if format is set
+func (s *ServerSettings) serveStream(c *gin.Context, stream *stagedStream) {
+	c.Header("Content-Type", "application/x-tar")
+	// Decompressed size is not known upfront and proxied archives are fetched once
+	if c.Request.Method == http.MethodHead {
+		c.Status(http.StatusOK)
+		return
+	}
+	resp, err := s.Fetcher.Get(c.Request.Context(), stream.source)
+	if err != nil {
+		c.String(http.StatusBadGateway, redactPresigned(err.Error()))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.String(http.StatusBadGateway, fmt.Sprintf("failed to fetch %s: returned %s", redactPresigned(stream.source), resp.Status))
+		return
+	}
+	r, err := stream.format.decompress(resp.Body)
+	if err != nil {
+		c.String(http.StatusBadGateway, fmt.Sprintf("failed to decompress %s: %v", redactPresigned(stream.source), err))
+		return
+	}
+	defer r.Close()
+	c.Status(http.StatusOK)
+	if _, err := io.Copy(c.Writer, r); err != nil {
+		klog.Warningf("Failed to serve %s: %v", redactPresigned(stream.source), err)
+	}
+}
+
+// bundleHeader returns tar header of the bundled file. Headers are the same
+// for HEAD and GET requests, so that announced size matches the archive
+func bundleHeader(file ArchiveFile) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     file.Name,
+		Mode:     0o644,
+		Size:     file.Size,
+		ModTime:  time.Unix(0, 0),
+	}
+}
+
+// bundleSize calculates tar archive size of the bundled files
+func bundleSize(files []ArchiveFile) (int64, error) {
+	var size int64
+	for _, file := range files {
+		// Long names take extra header blocks
+		counter := &countingWriter{w: io.Discard}
+		if err := tar.NewWriter(counter).WriteHeader(bundleHeader(file)); err != nil {
+			return 0, fmt.Errorf("failed to build header for %s: %v", file.Name, err)
+		}
+		size += counter.n + (file.Size+tarBlockSize-1)/tarBlockSize*tarBlockSize
+	}
+	// Archive ends with two empty blocks
+	return size + 2*tarBlockSize, nil
+}
+
+// serveBundle fetches the files one by one and writes them as a tar archive
+func (s *ServerSettings) serveBundle(c *gin.Context, files []ArchiveFile) {
+	size, err := bundleSize(files)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Header("Content-Type", "application/x-tar")
+	c.Header("Content-Length", strconv.FormatInt(size, 10))
+	c.Status(http.StatusOK)
+	if c.Request.Method == http.MethodHead {
+		return
+	}
+	tw := tar.NewWriter(c.Writer)
+	for _, file := range files {
+		if err := s.writeBundleFile(c.Request.Context(), tw, file); err != nil {
+			// Headers are sent already, so the truncated archive makes tar fail in the init container
+			klog.Warningf("Failed to serve bundled %s: %v", file.URL, err)
+			return
+		}
+	}
+	if err := tw.Close(); err != nil {
+		klog.Warningf("Failed to finish bundle: %v", err)
+	}
+}
+
+func (s *ServerSettings) writeBundleFile(ctx context.Context, tw *tar.Writer, file ArchiveFile) error {
+	resp, err := s.Fetcher.Get(ctx, file.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch %s: returned %s", file.URL, resp.Status)
+	}
+	if err := tw.WriteHeader(bundleHeader(file)); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, resp.Body, file.Size)
+	return err
+}
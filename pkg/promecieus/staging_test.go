@@ -0,0 +1,163 @@
+package promecieus
+
+import (
+	"archive/tar"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdTar builds a zstd-compressed tar archive with a single file
+func zstdTar(t *testing.T, name, content string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw, err := zstd.NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestHandleStagedDecompressesZstd(t *testing.T) {
+	archive := zstdTar(t, "wal/00000000", "segment")
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive)
+	}))
+	defer source.Close()
+
+	gin.SetMode(gin.TestMode)
+	s := &ServerSettings{
+		Fetcher: testFetcher(),
+		Staging: &Staging{Dir: t.TempDir(), TTL: time.Hour, InternalURL: "http://promecieus"},
+	}
+	r := gin.New()
+	r.GET("/staging/:token/prometheus.tar", s.HandleStaged)
+
+	token, err := s.Staging.Decompress(source.URL+"/prometheus.tar.zst", FormatZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/staging/"+token+"/prometheus.tar", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	format, err := detectArchiveFormat(w.Body.Bytes())
+	if err != nil || format != FormatTar {
+		t.Fatalf("expected plain tar, got %s, %v", format, err)
+	}
+	header, err := tar.NewReader(w.Body).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Name != "wal/00000000" {
+		t.Errorf("unexpected archive member %s", header.Name)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/staging/unknown/prometheus.tar", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown token, got %d", w.Code)
+	}
+}
+
+func TestFetchScriptUsesDecompressedArchive(t *testing.T) {
+	script, env := fetchScript([]MetricsArchive{{
+		URL:       "https://example.com/prometheus.tar.zst",
+		Format:    FormatZstd,
+		StagedURL: "http://promecieus/staging/token/prometheus.tar",
+	}})
+	if strings.Contains(script, "dnf") || strings.Contains(script, "--zstd") {
+		t.Errorf("script should not depend on zstd in the fetcher image: %s", script)
+	}
+	if !strings.Contains(script, "tar xv --exclude=.") {
+		t.Errorf("expected plain tar extraction: %s", script)
+	}
+	if len(env) != 1 || env[0].Value != "http://promecieus/staging/token/prometheus.tar" {
+		t.Errorf("expected staged URL to be fetched, got %+v", env)
+	}
+}
+
+func TestHandleStagedBundlesFiles(t *testing.T) {
+	longDir := "must-gather.local.1/quay-io-openshift-release-dev-ocp-v4-0-art-dev-sha256-0123456789abcdef0123456789abcdef/monitoring/prometheus-db/"
+	files := map[string]string{
+		"/meta.json": `{"ulid": "01HXYZ0000000000000000ABCD"}`,
+		"/wal":       "segment",
+	}
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(files[r.URL.Path]))
+	}))
+	defer source.Close()
+
+	gin.SetMode(gin.TestMode)
+	s := &ServerSettings{
+		Fetcher: testFetcher(),
+		Staging: &Staging{Dir: t.TempDir(), TTL: time.Hour, InternalURL: "http://promecieus"},
+	}
+	r := gin.New()
+	r.GET("/staging/:token/prometheus.tar", s.HandleStaged)
+	r.HEAD("/staging/:token/prometheus.tar", s.HandleStaged)
+
+	token, err := s.Staging.Bundle([]ArchiveFile{
+		{Name: longDir + "01HXYZ0000000000000000ABCD/meta.json", URL: source.URL + "/meta.json", Size: int64(len(files["/meta.json"]))},
+		{Name: longDir + "wal/00000000", URL: source.URL + "/wal", Size: int64(len(files["/wal"]))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := httptest.NewRecorder()
+	r.ServeHTTP(head, httptest.NewRequest(http.MethodHead, "/staging/"+token+"/prometheus.tar", nil))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/staging/"+token+"/prometheus.tar", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if head.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("announced size %s does not match archive size %d", head.Header().Get("Content-Length"), w.Body.Len())
+	}
+	contents, err := readTarContents(tar.NewReader(w.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contents.HasWAL || len(contents.Blocks) != 1 {
+		t.Errorf("expected a block and WAL in the bundle, got %s", contents)
+	}
+	if !contents.dataDirs[strings.TrimSuffix(longDir, "/")] {
+		t.Errorf("expected data directory %s, got %v", longDir, contents.dataDirs)
+	}
+}
+
+func TestStagedStreamOutlivesPresignedLink(t *testing.T) {
+	s := &Staging{TTL: time.Hour, InternalURL: "http://promecieus"}
+	token, err := s.Proxy("https://s3.example.com/bucket/prometheus.tar?X-Amz-Signature=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, ok := s.lookupStream(token)
+	if !ok {
+		t.Fatal("expected stream to be staged")
+	}
+	if time.Until(stream.expires) < s3LinkExpiration-time.Minute {
+		t.Errorf("stream expires in %s, before presigned link which is valid for %s", time.Until(stream.expires), s3LinkExpiration)
+	}
+}
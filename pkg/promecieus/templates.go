@@ -0,0 +1,285 @@
+package promecieus
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	routeApi "github.com/openshift/api/route/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	deploymentTemplate = "deployment.yaml"
+	serviceTemplate    = "service.yaml"
+	routeTemplate      = "route.yaml"
+)
+
+// defaultTemplates are used for manifests missing in prom-templates ConfigMap
+//
+//go:embed templates/*.yaml
+var defaultTemplates embed.FS
+
+var templateFuncs = template.FuncMap{
+	// toJSON renders values as JSON, which is valid YAML and keeps scripts and URLs quoted
+	"toJSON": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// manifestParams are variables available in manifest templates
+type manifestParams struct {
+	AppLabel        string
+	Name            string
+	Namespace       string
+	Cluster         string
+	MetricsURL      string
+	Started         time.Time
+	Finished        time.Time
+	PrometheusImage string
+	FetcherImage    string
+	FetchScript     string
+	FetchEnv        []corev1.EnvVar
+	// BackfillScript is empty when there are no synthetic series to backfill
+	BackfillScript string
+	Annotations    map[string]string
+	Resources      corev1.ResourceRequirements
+	EmptyDir       corev1.EmptyDirVolumeSource
+	// Host is the instance host name, empty if it is generated by the cluster
+	Host string
+	// RoutePrefix and ExternalURL are set when the instance is served under a path of promecieus proxy
+	RoutePrefix string
+	ExternalURL string
+	Exposure    ExposureSettings
+}
+
+// sampleParams are used to check that templates render valid manifests
+var sampleParams = manifestParams{
+	AppLabel:        "abcdefgh",
+	Name:            "abcdefgh-prom",
+	Namespace:       "promecieus",
+	MetricsURL:      storagePrefix + "/bucket/" + promTarPath,
+	Started:         time.Now().Add(-time.Hour),
+	Finished:        time.Now(),
+	PrometheusImage: prometheusImage,
+	FetcherImage:    ciFetcherImage,
+	FetchScript:     "set -uxo pipefail && curl -sL ${PROMTAR} | tar xv",
+	FetchEnv:        []corev1.EnvVar{{Name: "PROMTAR", Value: storagePrefix + "/bucket/" + promTarPath}},
+	BackfillScript:  backfillScript(),
+	Annotations:     map[string]string{metadataAnnotationPrefix + "job": "periodic-ci-job"},
+	Resources: corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("500Mi")},
+	},
+	EmptyDir: corev1.EmptyDirVolumeSource{SizeLimit: resource.NewQuantity(1<<30, resource.BinarySI)},
+	Host:     "abcdefgh.example.com",
+	Exposure: ExposureSettings{
+		TLSTermination: string(routeApi.TLSTerminationEdge),
+		IngressClass:   "nginx",
+		TLSSecret:      "promecieus-tls",
+		Gateway:        "gateway",
+	},
+}
+
+// ManifestTemplates keeps templates of Deployment, Service and Route created for each instance
+// and rules to size their resources
+type ManifestTemplates struct {
+	sync.RWMutex
+	templates map[string]*template.Template
+	sizing    []SizingRule
+}
+
+// renderedManifests are objects created for an instance
+type renderedManifests struct {
+	deployment *appsv1.Deployment
+	service    *corev1.Service
+	// exposure is a Route, Ingress or HTTPRoute, depending on the exposure backend.
+	// It's nil for the proxy backend
+	exposure metav1.Object
+}
+
+// parseTemplates parses manifests from the ConfigMap data, falling back to embedded defaults
+// for missing keys. Templates are rendered with sample params to catch errors early
+func parseTemplates(data map[string]string) (map[string]*template.Template, error) {
+	templates := map[string]*template.Template{}
+	for _, name := range []string{deploymentTemplate, serviceTemplate, routeTemplate, ingressTemplate, httpRouteTemplate} {
+		text, ok := data[name]
+		if !ok {
+			defaultText, err := defaultTemplates.ReadFile("templates/" + name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read default %s template: %v", name, err)
+			}
+			text = string(defaultText)
+		}
+		tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s template: %v", name, err)
+		}
+		templates[name] = tmpl
+	}
+	// Templates of all exposure backends are checked, so that switching backends won't break
+	for exposureTemplate := range exposureObjects {
+		if _, err := renderTemplates(templates, exposureTemplate, sampleParams); err != nil {
+			return nil, err
+		}
+	}
+	proxyParams := sampleParams
+	proxyParams.RoutePrefix = proxyRoutePrefix(sampleParams.AppLabel)
+	proxyParams.ExternalURL = "https://promecieus.example.com" + proxyParams.RoutePrefix
+	if _, err := renderTemplates(templates, "", proxyParams); err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+// renderTemplates executes templates and decodes manifests, rejecting unknown fields
+func renderTemplates(templates map[string]*template.Template, exposureTemplate string, params manifestParams) (*renderedManifests, error) {
+	manifests := &renderedManifests{
+		deployment: &appsv1.Deployment{},
+		service:    &corev1.Service{},
+	}
+	objects := map[string]metav1.Object{
+		deploymentTemplate: manifests.deployment,
+		serviceTemplate:    manifests.service,
+	}
+	if exposureTemplate != "" {
+		manifests.exposure = exposureObjects[exposureTemplate]()
+		objects[exposureTemplate] = manifests.exposure
+	}
+	for name, obj := range objects {
+		var b bytes.Buffer
+		if err := templates[name].Execute(&b, params); err != nil {
+			return nil, fmt.Errorf("failed to render %s template: %v", name, err)
+		}
+		if err := yaml.UnmarshalStrict(b.Bytes(), obj); err != nil {
+			return nil, fmt.Errorf("invalid manifest rendered from %s template: %v", name, err)
+		}
+	}
+
+	// Instances are found and removed by app label
+	for name, meta := range objects {
+		if meta.GetLabels()["app"] != params.AppLabel {
+			return nil, fmt.Errorf("manifest rendered from %s template must have app=%s label", name, params.AppLabel)
+		}
+	}
+	podSpec := manifests.deployment.Spec.Template
+	if podSpec.Labels["app"] != params.AppLabel {
+		return nil, fmt.Errorf("pods rendered from %s template must have app=%s label", deploymentTemplate, params.AppLabel)
+	}
+	// Logs of failed instances are read from these containers
+	if !hasContainer(podSpec.Spec.InitContainers, promInitContainerName) || !hasContainer(podSpec.Spec.Containers, promContainerName) {
+		return nil, fmt.Errorf("pods rendered from %s template must have %s init container and %s container",
+			deploymentTemplate, promInitContainerName, promContainerName)
+	}
+	return manifests, nil
+}
+
+func hasContainer(containers []corev1.Container, name string) bool {
+	for _, c := range containers {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NewManifestTemplates returns embedded default templates
+func NewManifestTemplates() (*ManifestTemplates, error) {
+	m := &ManifestTemplates{}
+	if err := m.update(nil); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LoadManifestTemplates reads templates from prom-templates ConfigMap, defaults are used if it doesn't exist
+func LoadManifestTemplates(ctx context.Context, k8sC *k8s.Clientset, namespace string) (*ManifestTemplates, error) {
+	m, err := NewManifestTemplates()
+	if err != nil {
+		return nil, err
+	}
+	cm, err := k8sC.CoreV1().ConfigMaps(namespace).Get(ctx, promTemplates, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		klog.Infof("ConfigMap %s not found, using default templates", promTemplates)
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ConfigMap %s: %v", promTemplates, err)
+	}
+	if err := m.update(cm.Data); err != nil {
+		return nil, fmt.Errorf("invalid templates in ConfigMap %s: %v", promTemplates, err)
+	}
+	return m, nil
+}
+
+// update replaces templates and sizing rules if all of them are valid
+func (m *ManifestTemplates) update(data map[string]string) error {
+	templates, err := parseTemplates(data)
+	if err != nil {
+		return err
+	}
+	sizing, err := parseSizingRules(data)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.templates = templates
+	m.sizing = sizing
+	return nil
+}
+
+func (m *ManifestTemplates) sizingRules() []SizingRule {
+	m.RLock()
+	defer m.RUnlock()
+	return m.sizing
+}
+
+func (m *ManifestTemplates) render(exposureTemplate string, params manifestParams) (*renderedManifests, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return renderTemplates(m.templates, exposureTemplate, params)
+}
+
+// WatchManifestTemplates reloads templates when prom-templates ConfigMap changes.
+// Invalid changes are rejected and previous templates are kept
+func (s *ServerSettings) WatchManifestTemplates(ctx context.Context) {
+	watchtools.UntilWithSync(ctx,
+		cache.NewListWatchFromClient(
+			s.K8sClient.CoreV1().RESTClient(), "configmaps", s.Namespace, fields.OneTermEqualSelector("metadata.name", promTemplates)),
+		&corev1.ConfigMap{},
+		nil,
+		func(event watch.Event) (bool, error) {
+			cm, ok := event.Object.(*corev1.ConfigMap)
+			if !ok {
+				return false, nil
+			}
+			data := cm.Data
+			if event.Type == watch.Deleted {
+				data = nil
+			}
+			if err := s.Templates.update(data); err != nil {
+				klog.Errorf("Rejected templates from ConfigMap %s: %v", promTemplates, err)
+				return false, nil
+			}
+			klog.Infof("Reloaded templates from ConfigMap %s", promTemplates)
+			return false, nil
+		},
+	)
+}
@@ -0,0 +1,381 @@
+package promecieus
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	blockMetaFile   = "meta.json"
+	blockIndexFile  = "index"
+	walDir          = "wal"
+	ulidAlphabet    = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	tarBlockSize    = 512
+	rangeWindowSize = 64 * 1024
+	// tsdbStreamLimit is the number of bytes read from compressed archives to find block metadata
+	tsdbStreamLimit = 256 * 1024 * 1024
+	tsdbScanTimeout = time.Minute
+)
+
+// blockMeta is the part of TSDB block meta.json we're interested in
+type blockMeta struct {
+	ULID    string `json:"ulid"`
+	MinTime int64  `json:"minTime"`
+	MaxTime int64  `json:"maxTime"`
+	Stats   struct {
+		NumSamples uint64 `json:"numSamples"`
+		NumSeries  uint64 `json:"numSeries"`
+	} `json:"stats"`
+}
+
+// blocksSummary describes data range of all blocks in the archive
+type blocksSummary struct {
+	Blocks     int
+	MinTime    time.Time
+	MaxTime    time.Time
+	Covered    time.Duration
+	NumSamples uint64
+}
+
+func (b blocksSummary) String() string {
+	if b.Blocks == 0 {
+		return "no blocks"
+	}
+	return fmt.Sprintf("%d blocks from %s to %s, %s covered, %d samples",
+		b.Blocks, b.MinTime.UTC().Format(time.RFC3339), b.MaxTime.UTC().Format(time.RFC3339), b.Covered, b.NumSamples)
+}
+
+// summarizeBlocks calculates time range covered by blocks, overlapping blocks are counted once
+func summarizeBlocks(blocks []blockMeta) blocksSummary {
+	summary := blocksSummary{Blocks: len(blocks)}
+	if len(blocks) == 0 {
+		return summary
+	}
+	sorted := make([]blockMeta, len(blocks))
+	copy(sorted, blocks)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].MinTime < sorted[j].MinTime })
+
+	var covered, curMin, curMax int64
+	curMin, curMax = sorted[0].MinTime, sorted[0].MaxTime
+	minTime, maxTime := curMin, curMax
+	for _, b := range sorted {
+		summary.NumSamples += b.Stats.NumSamples
+		if b.MaxTime > maxTime {
+			maxTime = b.MaxTime
+		}
+		if b.MinTime > curMax {
+			covered += curMax - curMin
+			curMin, curMax = b.MinTime, b.MaxTime
+			continue
+		}
+		if b.MaxTime > curMax {
+			curMax = b.MaxTime
+		}
+	}
+	covered += curMax - curMin
+
+	summary.MinTime = time.UnixMilli(minTime)
+	summary.MaxTime = time.UnixMilli(maxTime)
+	summary.Covered = time.Duration(covered) * time.Millisecond
+	return summary
+}
+
+// archiveContents is a summary of TSDB files found in the archive
+type archiveContents struct {
+	Head   archiveHead
+	Format ArchiveFormat
+	Blocks []blockMeta
+	HasWAL bool
+	// Partial is set when only the start of the archive was read
+	Partial bool
+	// DataSize is the total size of files found, it is the unpacked size unless contents are partial
+	DataSize int64
+	// readBytes is the number of compressed bytes read to find the contents
+	readBytes int64
+	// blockFiles lists index and meta.json files found in each block directory
+	blockFiles map[string][]string
+	// dataDirs are paths of prometheus data directories inside the archive
+	dataDirs map[string]bool
+}
+
+func (c *archiveContents) String() string {
+	summary := fmt.Sprintf("%s archive, %s", c.Format, summarizeBlocks(c.Blocks))
+	if c.HasWAL {
+		summary += " and WAL"
+	}
+	if c.Partial {
+		summary += " in the first " + strconv.FormatInt(tsdbStreamLimit/1024/1024, 10) + "MiB"
+	}
+	return summary
+}
+
+// unpackedSize returns the size of extracted archive. Size of partially read archives
+// is extrapolated using the compression ratio of the part read
+func (c *archiveContents) unpackedSize() int64 {
+	if !c.Partial || c.readBytes == 0 || c.Head.Size <= c.readBytes {
+		return c.DataSize
+	}
+	return int64(float64(c.DataSize) * float64(c.Head.Size) / float64(c.readBytes))
+}
+
+// maxSeries returns the largest number of series in a single block, which
+// approximates the number of series prometheus keeps in memory
+func (c *archiveContents) maxSeries() uint64 {
+	var series uint64
+	for _, b := range c.Blocks {
+		series = max(series, b.Stats.NumSeries)
+	}
+	return series
+}
+
+// validate checks that the archive looks like a prometheus data directory
+func (c *archiveContents) validate() error {
+	if len(c.blockFiles) == 0 && !c.HasWAL {
+		return fmt.Errorf("no TSDB blocks or WAL found")
+	}
+	if c.Partial {
+		return nil
+	}
+	blocks := make([]string, 0, len(c.blockFiles))
+	for block := range c.blockFiles {
+		blocks = append(blocks, block)
+	}
+	sort.Strings(blocks)
+	for _, block := range blocks {
+		for _, required := range []string{blockMetaFile, blockIndexFile} {
+			if !slices.Contains(c.blockFiles[block], required) {
+				return fmt.Errorf("block %s is incomplete: %s is missing", block, required)
+			}
+		}
+	}
+	return nil
+}
+
+// validateArchive reads the archive table of contents and checks that it is a TSDB snapshot
+func (f *Fetcher) validateArchive(ctx context.Context, archiveURL string) (*archiveContents, error) {
+	head, err := f.checkArchive(ctx, archiveURL)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := f.readArchiveContents(ctx, archiveURL, head)
+	if err != nil {
+		return nil, err
+	}
+	if err := contents.validate(); err != nil {
+		return nil, fmt.Errorf("%s is not a prometheus snapshot: %v", archiveURL, err)
+	}
+	return contents, nil
+}
+
+// readArchiveContents lists TSDB blocks in the archive. Uncompressed archives are read
+// with HTTP range requests, which skip file contents. Compressed archives have to be
+// streamed, so only the start of large archives is read
+func (f *Fetcher) readArchiveContents(ctx context.Context, archiveURL string, head archiveHead) (*archiveContents, error) {
+	ctx, cancel := context.WithTimeout(ctx, tsdbScanTimeout)
+	defer cancel()
+
+	if head.AcceptRanges && head.Size > 0 {
+		rr := &rangeReader{ctx: ctx, fetcher: f, url: archiveURL}
+		tarHeader := make([]byte, tarBlockSize)
+		_, err := rr.ReadAt(tarHeader, 0)
+		switch {
+		case err != nil:
+			klog.Infof("failed to read %s using range requests: %v", archiveURL, err)
+		case isPlainTar(tarHeader):
+			contents, err := readTarContents(tar.NewReader(io.NewSectionReader(rr, 0, head.Size)))
+			if err != nil {
+				return nil, err
+			}
+			contents.Head, contents.Format = head, FormatTar
+			return contents, nil
+		}
+	}
+	contents, err := f.streamArchiveContents(ctx, archiveURL)
+	if err != nil {
+		return nil, err
+	}
+	contents.Head = head
+	return contents, nil
+}
+
+// countingReader counts bytes read from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// streamArchiveContents reads the archive up to tsdbStreamLimit bytes, decompressing it if needed
+func (f *Fetcher) streamArchiveContents(ctx context.Context, archiveURL string) (*archiveContents, error) {
+	resp, err := f.Get(ctx, archiveURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: returned %s", archiveURL, resp.Status)
+	}
+
+	counter := &countingReader{r: io.LimitReader(resp.Body, tsdbStreamLimit)}
+	br := bufio.NewReader(counter)
+	header, err := br.Peek(tarBlockSize)
+	if err != nil && len(header) == 0 {
+		return nil, fmt.Errorf("failed to read %s: %v", archiveURL, err)
+	}
+	format, err := detectArchiveFormat(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", archiveURL, err)
+	}
+	r, err := format.decompress(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %v", archiveURL, err)
+	}
+	defer r.Close()
+
+	contents, err := readTarContents(tar.NewReader(r))
+	contents.Format = format
+	contents.readBytes = counter.n
+	if counter.n >= tsdbStreamLimit {
+		// Archive is not read till the end, so the last entry is expected to be cut
+		contents.Partial = true
+		return contents, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s, archive may be truncated: %v", archiveURL, err)
+	}
+	return contents, nil
+}
+
+// readTarContents reads meta.json of every block in the tar stream.
+// Contents found so far are returned along with the read error
+func readTarContents(tr *tar.Reader) (*archiveContents, error) {
+	contents := &archiveContents{Blocks: []blockMeta{}, blockFiles: map[string][]string{}, dataDirs: map[string]bool{}}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return contents, nil
+		}
+		if err != nil {
+			return contents, fmt.Errorf("failed to read tar: %v", err)
+		}
+		name := path.Clean("/" + hdr.Name)
+		if hdr.Typeflag == tar.TypeReg {
+			contents.DataSize += hdr.Size
+		}
+		// Data directory contains WAL and block directories named after block ULIDs
+		segments := splitPath(hdr.Name)
+		for i, segment := range segments {
+			if segment == walDir {
+				contents.HasWAL = true
+				contents.dataDirs[strings.Join(segments[:i], "/")] = true
+				break
+			}
+			if isBlockULID(segment) {
+				contents.dataDirs[strings.Join(segments[:i], "/")] = true
+				if _, ok := contents.blockFiles[segment]; !ok {
+					contents.blockFiles[segment] = []string{}
+				}
+				if hdr.Typeflag == tar.TypeReg && i == len(segments)-2 {
+					contents.blockFiles[segment] = append(contents.blockFiles[segment], path.Base(name))
+				}
+				break
+			}
+		}
+		if hdr.Typeflag != tar.TypeReg || path.Base(name) != blockMetaFile {
+			continue
+		}
+		var meta blockMeta
+		if err := json.NewDecoder(tr).Decode(&meta); err != nil {
+			return contents, fmt.Errorf("failed to unmarshal %s: %v", hdr.Name, err)
+		}
+		contents.Blocks = append(contents.Blocks, meta)
+	}
+}
+
+// isBlockULID checks if the name is a valid ULID, used as a block directory name
+func isBlockULID(name string) bool {
+	if len(name) != 26 {
+		return false
+	}
+	for _, r := range name {
+		if !strings.ContainsRune(ulidAlphabet, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// rangeReader reads a remote file using HTTP range requests. The last fetched window
+// is kept, so that adjacent tar headers are read with a single request
+type rangeReader struct {
+	ctx         context.Context
+	fetcher     *Fetcher
+	url         string
+	windowStart int64
+	window      []byte
+}
+
+func (r *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < r.windowStart || off+int64(len(p)) > r.windowStart+int64(len(r.window)) {
+		if err := r.fetch(off, max(int64(len(p)), rangeWindowSize)); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.window[off-r.windowStart:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *rangeReader) fetch(off, size int64) error {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+size-1))
+	resp, err := r.fetcher.Do(r.ctx, http.MethodGet, r.url, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		return io.EOF
+	default:
+		return fmt.Errorf("range request to %s returned %s", r.url, resp.Status)
+	}
+	window, err := io.ReadAll(io.LimitReader(resp.Body, size))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", r.url, err)
+	}
+	r.windowStart, r.window = off, window
+	return nil
+}
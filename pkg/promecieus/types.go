@@ -1,11 +1,12 @@
 package promecieus
 
 import (
+	"context"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
-	routeClient "github.com/openshift/client-go/route/clientset/versioned/typed/route/v1"
+	corev1 "k8s.io/api/core/v1"
 	k8s "k8s.io/client-go/kubernetes"
 )
 
@@ -20,6 +21,8 @@ type GrafanaSettings struct {
 type RQuotaStatus struct {
 	Used int64 `json:"used"`
 	Hard int64 `json:"hard"`
+	// HardResources are all limits of the quota, used to refuse instances which can never fit
+	HardResources corev1.ResourceList `json:"-"`
 }
 
 type OpenSockets struct {
@@ -27,16 +30,56 @@ type OpenSockets struct {
 	list map[string]*websocket.Conn
 }
 
+// PendingSelections keeps instances waiting for the user to pick a metrics archive
+type PendingSelections struct {
+	sync.Mutex
+	list map[string]chan candidateSelection
+}
+
+// candidateSelection is an archive picked by the user and an optional paired archive
+type candidateSelection struct {
+	url  string
+	pair string
+}
+
+// PendingCreations keeps cancel functions of instances being created.
+// Users following the same instance cancel their own requests only, so these are keyed by socket too
+type PendingCreations struct {
+	sync.Mutex
+	list map[creationKey][]*pendingCreation
+}
+
+type creationKey struct {
+	conn     *websocket.Conn
+	appLabel string
+}
+
+// pendingCreation is a request for the instance, cancel stops waiting for it
+type pendingCreation struct {
+	cancel context.CancelFunc
+}
+
 // ServerSettings stores info about the server
 type ServerSettings struct {
 	K8sClient   *k8s.Clientset
-	RouteClient *routeClient.RouteV1Client
+	Exposer     Exposer
 	Namespace   string
 	RQuotaName  string
 	RQStatus    *RQuotaStatus
 	Conns       *OpenSockets
 	Datasources map[string]int
+	// Annotations are IDs of grafana annotations, removed along with the datasource
+	Annotations map[string][]int
+	dsLock      sync.Mutex
 	Grafana     *GrafanaSettings
+	Resolvers   *ResolverRegistry
+	Selections  *PendingSelections
+	Creations   *PendingCreations
+	Instances   *InstanceStreams
+	References  *InstanceReferences
+	Staging     *Staging
+	Fetcher     *Fetcher
+	Templates   *ManifestTemplates
 }
 
 // ProwJSON stores test start / finished timestamp
@@ -46,7 +89,77 @@ type ProwJSON struct {
 
 // ProwInfo stores all links and data collected via scanning for metrics
 type ProwInfo struct {
-	Started    time.Time
-	Finished   time.Time
-	MetricsURL string
+	// Job is set when archive belongs to a Prow job run
+	Job        *ProwJob  `json:"job,omitempty"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	MetricsURL string    `json:"metricsURL"`
+	// Size of the archive in bytes, zero if unknown
+	Size int64 `json:"size"`
+	// Snapshot of the other prometheus-k8s replica, empty if not found
+	ReplicaURL  string `json:"replicaURL,omitempty"`
+	ReplicaSize int64  `json:"replicaSize,omitempty"`
+	// Archives to be extracted into the instance. MetricsURL is used when empty
+	Archives []MetricsArchive `json:"archives,omitempty"`
+	// All archives found in the job, MetricsURL points to one of them
+	Candidates []MetricsCandidate `json:"candidates,omitempty"`
+	// Cluster is set for HyperShift jobs: management or hosted
+	Cluster string `json:"cluster,omitempty"`
+	// Pair is an instance started alongside this one, i.e. for the other HyperShift cluster
+	Pair *ProwInfo `json:"pair,omitempty"`
+	// Metadata describes the Prow job run, nil if archive does not belong to a job
+	Metadata *JobMetadata `json:"metadata,omitempty"`
+	// Failures are failed tests of the job, posted as grafana annotations
+	Failures []TestFailure `json:"failures,omitempty"`
+	// Backfill are job artifacts converted into synthetic series
+	Backfill []BackfillSource `json:"backfill,omitempty"`
+	// BackfillURLs are staged OpenMetrics files, written into TSDB blocks before prometheus starts
+	BackfillURLs []string `json:"backfillURLs,omitempty"`
+	// Sizing is resources picked for the instance once archives are validated
+	Sizing *InstanceSizing `json:"sizing,omitempty"`
+	// artifacts are found in all tests of the job, useCandidate picks those of the selected test
+	artifacts *jobArtifacts
+	// validated is false when archives were not checked as the instance for them is already running
+	validated bool
+}
+
+// jobArtifacts are artifacts of all tests in the job
+type jobArtifacts struct {
+	failures []TestFailure
+	backfill []BackfillSource
+}
+
+// MetricsCandidate is a prometheus archive found in job artifacts
+type MetricsCandidate struct {
+	Test        string `json:"test"`
+	Step        string `json:"step"`
+	URL         string `json:"url"`
+	Size        int64  `json:"size"`
+	ReplicaURL  string `json:"replicaURL,omitempty"`
+	ReplicaSize int64  `json:"replicaSize,omitempty"`
+	Cluster     string `json:"cluster,omitempty"`
+	// jobMetricsURL is job_metrics.json found next to the archive, jobMetrics are its values
+	jobMetricsURL string
+	jobMetrics    map[string]string
+}
+
+// MetricsArchive is a single archive extracted into prometheus storage
+type MetricsArchive struct {
+	URL string `json:"url"`
+	// Root is the prometheus data directory inside the archive, empty if data is at the top level
+	Root string `json:"root,omitempty"`
+	// Format is detected during archive validation
+	Format ArchiveFormat `json:"format,omitempty"`
+	// StagedURL serves the archive decompressed by promecieus, set for zstd archives
+	StagedURL string `json:"stagedURL,omitempty"`
+	// Files are set when URL is an unpacked data directory, which is served by staging as a tar
+	Files []ArchiveFile `json:"files,omitempty"`
+}
+
+// ArchiveFile is a file of unpacked prometheus data directory
+type ArchiveFile struct {
+	// Name is the path of the file inside the archive
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	Size int64  `json:"size"`
 }
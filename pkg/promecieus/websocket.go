@@ -9,6 +9,8 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -28,6 +30,8 @@ type ContainerLogError struct {
 	Message string `json:"message"`
 }
 
+const candidateSelectionTimeout = 5 * time.Minute
+
 var wsupgrader = websocket.Upgrader{
 	ReadBufferSize:   1048576,
 	WriteBufferSize:  1048576,
@@ -38,16 +42,34 @@ var wsupgrader = websocket.Upgrader{
 	},
 }
 
+// wsWriteLocks serializes writes to a connection, as several instances may report to the same socket
+var wsWriteLocks sync.Map
+
 func sendWSMessage(conn *websocket.Conn, action string, message string) {
+	sendWSMessageWithData(conn, action, message, nil)
+}
+
+// sendWSMessageWithData sends a message to the page. Presigned links are credentials,
+// so they are removed from the message and data
+func sendWSMessageWithData(conn *websocket.Conn, action string, message string, data map[string]string) {
 	response := WSMessage{
 		Action:  action,
-		Message: message,
+		Message: redactPresigned(message),
+	}
+	if data != nil {
+		response.Data = make(map[string]string, len(data))
+		for key, value := range data {
+			response.Data[key] = redactPresigned(value)
+		}
 	}
 	responseJSON, err := json.Marshal(response)
 	if err != nil {
 		klog.Fatalf("Can't serialize %v", response)
 	}
 	if conn != nil {
+		lock, _ := wsWriteLocks.LoadOrStore(conn, &sync.Mutex{})
+		lock.(*sync.Mutex).Lock()
+		defer lock.(*sync.Mutex).Unlock()
 		conn.WriteMessage(websocket.TextMessage, responseJSON)
 	}
 }
@@ -61,7 +83,9 @@ func (s *ServerSettings) HandleStatusViaWS(c *gin.Context) {
 		return
 	}
 
-	ctx := context.Background()
+	// Instances which are still being created are cancelled when the socket is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	for {
 		t, msg, err := conn.ReadMessage()
@@ -71,6 +95,7 @@ func (s *ServerSettings) HandleStatusViaWS(c *gin.Context) {
 				s.RemoveWS(conn)
 				klog.Warningf("Error reading message: %+v", err)
 			}
+			wsWriteLocks.Delete(conn)
 			break
 		}
 		if t != websocket.TextMessage {
@@ -91,7 +116,17 @@ func (s *ServerSettings) HandleStatusViaWS(c *gin.Context) {
 		case "new":
 			go s.createNewPrometheus(ctx, conn, m.Message)
 		case "delete":
-			go s.removeProm(ctx, conn, m.Message)
+			go s.removeProm(context.Background(), conn, m.Message)
+		case "cancel":
+			s.Creations.Cancel(conn, m.Message)
+		case "job":
+			go s.createPrometheusForJob(ctx, conn, m.Data)
+		case "select":
+			s.Selections.Pick(m.Message, candidateSelection{url: m.Data["url"], pair: m.Data["pair"]})
+		case "payload":
+			go s.sendPayload(ctx, conn, m.Message)
+		case "launch":
+			go s.launchPayloadJobs(ctx, conn, m.Message)
 		}
 	}
 }
@@ -122,25 +157,205 @@ func (s *ServerSettings) sendResourceQuotaUpdate() {
 	}
 }
 
-func (s *ServerSettings) removeProm(ctx context.Context, conn *websocket.Conn, appName string) {
-	sendWSMessage(conn, "status", fmt.Sprintf("Removing app %s", appName))
-	if output, err := s.deletePods(ctx, appName); err != nil {
-		sendWSMessage(conn, "failure", fmt.Sprintf("%s\n%s", output, err.Error()))
+// Pick passes archive URL selected by the user to the instance waiting for it
+func (p *PendingSelections) Pick(appLabel string, selected candidateSelection) {
+	p.Lock()
+	defer p.Unlock()
+	selection, ok := p.list[appLabel]
+	if !ok {
+		klog.Warningf("No archive selection pending for %s", appLabel)
+		return
+	}
+	select {
+	case selection <- selected:
+	default:
+	}
+}
+
+func (p *PendingSelections) add(appLabel string) chan candidateSelection {
+	p.Lock()
+	defer p.Unlock()
+	if p.list == nil {
+		p.list = make(map[string]chan candidateSelection)
+	}
+	selection := make(chan candidateSelection, 1)
+	p.list[appLabel] = selection
+	return selection
+}
+
+func (p *PendingSelections) remove(appLabel string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.list, appLabel)
+}
+
+// selectCandidate sends all found archives to the user and waits for one to be picked
+func (s *ServerSettings) selectCandidate(ctx context.Context, conn *websocket.Conn, appLabel string, u *url.URL, prowInfo *ProwInfo) error {
+	// Archive can be preselected via 'step' query param
+	if step := u.Query().Get("step"); step != "" {
+		for _, c := range prowInfo.Candidates {
+			if c.Step == step || (c.Step == "" && c.Test == step) {
+				prowInfo.useCandidate(c)
+				return nil
+			}
+		}
+		return fmt.Errorf("no prometheus archive found for step %s", step)
+	}
+
+	candidatesJSON, err := json.Marshal(prowInfo.Candidates)
+	if err != nil {
+		return fmt.Errorf("failed to serialize candidates: %v", err)
+	}
+	selection := s.Selections.add(appLabel)
+	defer s.Selections.remove(appLabel)
+	sendWSMessage(conn, "candidates", string(candidatesJSON))
+
+	timer := time.NewTimer(candidateSelectionTimeout)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return fmt.Errorf("no prometheus archive selected in %s", candidateSelectionTimeout)
+	case selected := <-selection:
+		c, err := findCandidate(prowInfo.Candidates, selected.url)
+		if err != nil {
+			return err
+		}
+		prowInfo.useCandidate(*c)
+		if selected.pair == "" {
+			return nil
+		}
+		// Paired instance is started for the other cluster of HyperShift job
+		pc, err := findCandidate(prowInfo.Candidates, selected.pair)
+		if err != nil {
+			return err
+		}
+		pair := ProwInfo{
+			Job:       prowInfo.Job,
+			Started:   prowInfo.Started,
+			Finished:  prowInfo.Finished,
+			Metadata:  prowInfo.Metadata,
+			artifacts: prowInfo.artifacts,
+		}
+		pair.useCandidate(*pc)
+		prowInfo.Pair = &pair
+		return nil
+	}
+}
+
+// findCandidate returns candidate which archive was selected by the user.
+// The page gets links without presigned query strings, so they are compared redacted
+func findCandidate(candidates []MetricsCandidate, metricsURL string) (*MetricsCandidate, error) {
+	metricsURL = redactPresigned(metricsURL)
+	for _, c := range candidates {
+		if redactPresigned(c.URL) == metricsURL || (c.URL == "" && redactPresigned(c.ReplicaURL) == metricsURL) {
+			return &c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown archive %s selected", metricsURL)
+}
+
+// Cancel stops waiting for the instance requested via the socket.
+// Creation itself is cancelled once nobody else is waiting for the instance
+func (p *PendingCreations) Cancel(conn *websocket.Conn, appLabel string) {
+	p.Lock()
+	defer p.Unlock()
+	pending, ok := p.list[creationKey{conn: conn, appLabel: appLabel}]
+	if !ok {
+		klog.Warningf("No instance creation in progress for %s", appLabel)
 		return
 	}
-	dsID := s.Datasources[appName]
-	if err := s.removeDataSource(dsID); err != nil {
+	for _, creation := range pending {
+		creation.cancel()
+	}
+}
+
+// add registers a request for the instance and returns a function which removes it
+func (p *PendingCreations) add(conn *websocket.Conn, appLabel string, cancel context.CancelFunc) func() {
+	return p.addPending(creationKey{conn: conn, appLabel: appLabel}, &pendingCreation{cancel: cancel})
+}
+
+// alias makes requests for the instance cancellable by the label of the instance being followed.
+// It returns a function which removes the alias
+func (p *PendingCreations) alias(conn *websocket.Conn, appLabel string, alias string) func() {
+	p.Lock()
+	pending := slices.Clone(p.list[creationKey{conn: conn, appLabel: appLabel}])
+	p.Unlock()
+	removes := make([]func(), 0, len(pending))
+	for _, creation := range pending {
+		removes = append(removes, p.addPending(creationKey{conn: conn, appLabel: alias}, creation))
+	}
+	return func() {
+		for _, remove := range removes {
+			remove()
+		}
+	}
+}
+
+func (p *PendingCreations) addPending(key creationKey, creation *pendingCreation) func() {
+	p.Lock()
+	defer p.Unlock()
+	if p.list == nil {
+		p.list = make(map[creationKey][]*pendingCreation)
+	}
+	p.list[key] = append(p.list[key], creation)
+	return func() {
+		p.Lock()
+		defer p.Unlock()
+		p.list[key] = slices.DeleteFunc(p.list[key], func(c *pendingCreation) bool { return c == creation })
+		if len(p.list[key]) == 0 {
+			delete(p.list, key)
+		}
+	}
+}
+
+// removeProm drops the user's reference to the instance and deletes it once nobody else uses it
+func (s *ServerSettings) removeProm(ctx context.Context, conn *websocket.Conn, label string) {
+	appName, used := s.References.release(label)
+	if used {
+		sendWSMessage(conn, "done", fmt.Sprintf("Stopped using app %s, it's kept running for other users", appName))
+		return
+	}
+	sendWSMessage(conn, "status", fmt.Sprintf("Removing app %s", appName))
+	if err := s.deleteInstance(ctx, appName); err != nil {
 		sendWSMessage(conn, "failure", err.Error())
+		return
 	}
-	delete(s.Datasources, appName)
 	sendWSMessage(conn, "done", "Prometheus instance removed")
 }
 
+// deleteInstance removes pods of the instance along with its Grafana datasource and annotations, if these were added
+func (s *ServerSettings) deleteInstance(ctx context.Context, appName string) error {
+	if output, err := s.deletePods(ctx, appName); err != nil {
+		return fmt.Errorf("%s\n%s", output, err.Error())
+	}
+	s.dsLock.Lock()
+	dsID, hasDatasource := s.Datasources[appName]
+	delete(s.Datasources, appName)
+	annotationIDs := s.Annotations[appName]
+	delete(s.Annotations, appName)
+	s.dsLock.Unlock()
+	for _, id := range annotationIDs {
+		if err := s.removeAnnotation(id); err != nil {
+			klog.Warningf("Failed to remove annotation: %v", err)
+		}
+	}
+	if !hasDatasource {
+		return nil
+	}
+	return s.removeDataSource(dsID)
+}
+
 func (s *ServerSettings) createNewPrometheus(ctx context.Context, conn *websocket.Conn, rawURL string) {
 	// Generate a unique app label
 	appLabel := generateAppLabel()
 	sendWSMessage(conn, "app-label", appLabel)
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer s.Creations.add(conn, appLabel, cancel)()
+
 	// Fetch metrics.tar path if prow URL specified
 	u, err := url.Parse(rawURL)
 	if err != nil {
@@ -148,19 +363,115 @@ func (s *ServerSettings) createNewPrometheus(ctx context.Context, conn *websocke
 		return
 	}
 
-	prowInfo, err := getMetricsTar(conn, u)
+	prowInfo, err := s.getMetricsTar(ctx, conn, appLabel, u)
+	if ctx.Err() != nil {
+		sendWSMessage(conn, "failure", fmt.Sprintf("Creation of %s cancelled", appLabel))
+		return
+	}
 	if err != nil {
 		sendWSMessage(conn, "failure", fmt.Sprintf("Failed to find metrics archive: %s", err.Error()))
 		return
 	}
+	if prowInfo.Metadata != nil {
+		metadataJSON, err := json.Marshal(prowInfo.Metadata)
+		if err == nil {
+			sendWSMessageWithData(conn, "metadata", string(metadataJSON), map[string]string{"app": appLabel})
+		} else {
+			klog.Warningf("Failed to serialize job metadata: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	if prowInfo.Pair != nil {
+		// Cancelling either of paired instances cancels both
+		pairLabel := generateAppLabel()
+		defer s.Creations.add(conn, pairLabel, cancel)()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.startPrometheus(ctx, conn, pairLabel, *prowInfo.Pair, false)
+		}()
+	}
+	s.startPrometheus(ctx, conn, appLabel, prowInfo, true)
+	wg.Wait()
+}
+
+// abortPrometheus removes resources already created for the cancelled instance
+func (s *ServerSettings) abortPrometheus(appLabel string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return s.deleteInstance(ctx, appLabel)
+}
+
+// startPrometheus deploys a new instance for the archive found and waits for it to become ready.
+// Users requesting the same archives follow the instance being created. Primary instance label
+// is sent to followers, so that the page could cancel the instance it shows. Every user gets their
+// own label to remove the instance by, so that it's kept running for the others
+func (s *ServerSettings) startPrometheus(ctx context.Context, conn *websocket.Conn, appLabel string, prowInfo ProwInfo, primary bool) {
+	hash := prowInfo.archiveHash()
+	if existingLabel, instanceURL, ok := s.findInstance(ctx, hash); ok {
+		existingName := prowInfo.instanceName(existingLabel)
+		s.References.add(appLabel, existingLabel)
+		sendWSMessage(conn, "status", fmt.Sprintf("Reusing prometheus instance %s already running for this archive", existingName))
+		sendWSMessageWithData(conn, "link", instanceURL, map[string]string{"app": existingLabel, "cluster": prowInfo.Cluster})
+		sendWSMessageWithData(conn, "done", fmt.Sprintf("Pod %s is ready", existingName), map[string]string{"hash": appLabel, "url": instanceURL})
+		return
+	}
+	stream, started := s.Instances.start(hash, appLabel)
+	if started && !prowInfo.validated {
+		// Archives were not validated as the instance was running, but it's gone since then.
+		// Pair is started separately, so only archives of this instance are checked
+		sendWSMessage(conn, "status", fmt.Sprintf("Prometheus instance for this archive has been removed meanwhile, deploying %s instead", prowInfo.instanceName(appLabel)))
+		prowInfo.Pair = nil
+		if err := s.validateArchives(ctx, conn, &prowInfo); err != nil {
+			s.Instances.finish(hash, stream)
+			if ctx.Err() != nil {
+				sendWSMessage(conn, "failure", fmt.Sprintf("Creation of %s cancelled", prowInfo.instanceName(appLabel)))
+			} else {
+				sendWSMessage(conn, "failure", fmt.Sprintf("Failed to find metrics archive: %s", err.Error()))
+			}
+			return
+		}
+	}
+	if !started {
+		sendWSMessage(conn, "status", fmt.Sprintf("Prometheus instance %s is already being created for this archive, following its progress",
+			prowInfo.instanceName(stream.appLabel)))
+		defer s.Creations.alias(conn, appLabel, stream.appLabel)()
+	}
+	if done := stream.attach(conn, appLabel, primary && !started); done != nil {
+		// Instance got ready while the user was attaching
+		s.References.add(appLabel, stream.appLabel)
+		sendWSMessageWithData(conn, "done", done.Message, map[string]string{"hash": appLabel, "url": done.Data["url"]})
+	}
+	if started {
+		go s.createPrometheus(stream, hash, appLabel, prowInfo)
+	}
+	stream.wait(ctx, conn)
+}
+
+// createPrometheus runs creation of the instance until it's ready, failed or every user has left
+func (s *ServerSettings) createPrometheus(stream *instanceStream, hash string, appLabel string, prowInfo ProwInfo) {
+	defer s.Instances.finish(hash, stream)
+	ctx := stream.ctx
+	var err error
+
+	name := prowInfo.instanceName(appLabel)
+	ready := false
+	defer func() {
+		if !ready && ctx.Err() != nil {
+			if err := s.abortPrometheus(appLabel); err != nil {
+				stream.send("failure", fmt.Sprintf("Failed to remove %s: %v", name, err))
+			}
+			stream.send("failure", fmt.Sprintf("Creation of %s cancelled", name))
+		}
+	}()
 
 	// Create a new app in the namespace and return route
-	sendWSMessage(conn, "status", "Deploying a new prometheus instance")
+	stream.send("status", fmt.Sprintf("Deploying a new prometheus instance %s", name))
 
 	var promRoute string
-	metricsTar := prowInfo.MetricsURL
-	if promRoute, err = s.launchPromApp(ctx, appLabel, metricsTar); err != nil {
-		sendWSMessage(conn, "failure", fmt.Sprintf("Failed to run a new app: %s", err.Error()))
+	if promRoute, err = s.launchPromApp(ctx, appLabel, prowInfo); err != nil {
+		stream.send("failure", fmt.Sprintf("Failed to run a new app: %s", err.Error()))
 		return
 	}
 	// Calculate a range in minutes between start and finish
@@ -169,7 +480,7 @@ func (s *ServerSettings) createNewPrometheus(ctx context.Context, conn *websocke
 	// Send a sample query so that user would not have to rediscover start and finished time
 	prometheusURL, err := url.Parse(promRoute)
 	if err != nil {
-		sendWSMessage(conn, "failure", err.Error())
+		stream.send("failure", err.Error())
 		return
 	}
 
@@ -185,33 +496,54 @@ func (s *ServerSettings) createNewPrometheus(ctx context.Context, conn *websocke
 
 	//sendWSMessage(conn, "link", prometheusURL.String())
 	hackedPrometheusURL := fmt.Sprintf("%s/graph?g0.expr=up&%s", promRoute, params.Encode())
-	sendWSMessage(conn, "link", hackedPrometheusURL)
+	stream.sendWithData("link", hackedPrometheusURL, map[string]string{"app": appLabel, "cluster": prowInfo.Cluster})
 
-	sendWSMessage(conn, "progress", "Waiting for pods to be created")
-	if err := s.waitForDeploymentReady(ctx, appLabel, conn); err != nil {
+	stream.send("progress", "Waiting for pods to be created")
+	if err := s.waitForDeploymentReady(ctx, appLabel, stream); err != nil {
 		if errors.Is(err, ErrorContainerLog) {
-			sendWSMessage(conn, "error", err.Error())
+			stream.send("error", err.Error())
 		} else {
-			sendWSMessage(conn, "failure", err.Error())
+			stream.send("failure", err.Error())
 		}
 		return
 	}
 
-	if err := s.waitForEndpointReady(ctx, promRoute); err != nil {
-		sendWSMessage(conn, "failure", err.Error())
+	if err := s.waitForEndpointReady(ctx, s.Exposer.ProbeURL(appLabel, promRoute)); err != nil {
+		stream.send("failure", err.Error())
 		return
 	}
 
 	if s.Grafana.URL != "" && s.Grafana.Token != "" && s.Grafana.Cookie != "" {
-		dsID, err := s.addDataSource(appLabel, promRoute)
+		dsName := appLabel
+		if prowInfo.Cluster != "" {
+			dsName = fmt.Sprintf("%s-%s", appLabel, prowInfo.Cluster)
+		}
+		dsID, err := s.addDataSource(dsName, promRoute)
 		if err == nil {
+			s.dsLock.Lock()
 			s.Datasources[appLabel] = dsID
-			sendWSMessage(conn, "status", fmt.Sprintf("Added %s datasource at %s", appLabel, s.Grafana.URL))
+			s.dsLock.Unlock()
+			stream.send("status", fmt.Sprintf("Added %s datasource at %s", dsName, s.Grafana.URL))
+
+			// IDs are kept even on failure, so that posted annotations are removed with the datasource
+			ids, err := s.addTestAnnotations(dsName, prowInfo.Failures)
+			s.dsLock.Lock()
+			s.Annotations[appLabel] = ids
+			s.dsLock.Unlock()
+			if err != nil {
+				stream.send("failure", err.Error())
+			} else if len(ids) > 0 {
+				stream.send("status", fmt.Sprintf("Added %d test failure annotations tagged %s", len(ids), dsName))
+			}
 		} else {
-			sendWSMessage(conn, "failure", err.Error())
+			stream.send("failure", err.Error())
 		}
 	}
-	sendWSMessage(conn, "done", "Pod is ready")
+	if err := s.annotateInstanceURL(ctx, appLabel, hackedPrometheusURL); err != nil {
+		klog.Warningf("Instance %s won't be reused: %v", appLabel, err)
+	}
+	ready = true
+	stream.ready(s.References, fmt.Sprintf("Pod %s is ready", name), hackedPrometheusURL)
 }
 
 // GrafanaDatasource represents a datasource to be created
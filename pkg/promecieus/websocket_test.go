@@ -0,0 +1,136 @@
+package promecieus
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	k8s "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fakeKubeAPI serves empty lists of any resource and records requests other than lists
+type fakeKubeAPI struct {
+	sync.Mutex
+	requests []string
+}
+
+func (f *fakeKubeAPI) client(t *testing.T) *k8s.Clientset {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			f.Lock()
+			f.requests = append(f.requests, fmt.Sprintf("%s %s", r.Method, r.URL.Path))
+			f.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"items": []}`)
+	}))
+	t.Cleanup(server.Close)
+	client, err := k8s.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// grafanaRecorder records requests to Grafana API
+func grafanaRecorder(t *testing.T) (*GrafanaSettings, *[]string) {
+	t.Helper()
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, fmt.Sprintf("%s %s", r.Method, r.URL.Path))
+		fmt.Fprint(w, `{"message": "Data source deleted"}`)
+	}))
+	t.Cleanup(server.Close)
+	return &GrafanaSettings{URL: server.URL, Token: "token", Cookie: "cookie"}, &requests
+}
+
+func TestAbortPrometheusWithoutDatasource(t *testing.T) {
+	grafana, grafanaRequests := grafanaRecorder(t)
+	s := &ServerSettings{
+		K8sClient:   (&fakeKubeAPI{}).client(t),
+		Namespace:   "promecieus",
+		Exposer:     newProxyExposer(exposureBase{}, "promecieus"),
+		Grafana:     grafana,
+		Datasources: map[string]int{},
+		Annotations: map[string][]int{},
+	}
+	if err := s.abortPrometheus("abcde"); err != nil {
+		t.Fatal(err)
+	}
+	if len(*grafanaRequests) != 0 {
+		t.Errorf("expected Grafana not to be called for instance without datasource, got %q", *grafanaRequests)
+	}
+
+	s.Datasources["fghij"] = 42
+	if err := s.abortPrometheus("fghij"); err != nil {
+		t.Fatal(err)
+	}
+	if len(*grafanaRequests) != 1 || (*grafanaRequests)[0] != "DELETE /api/datasources/42" {
+		t.Errorf("expected datasource to be removed, got %q", *grafanaRequests)
+	}
+}
+
+func TestRemovePromKeepsInstanceForOtherUsers(t *testing.T) {
+	grafana, grafanaRequests := grafanaRecorder(t)
+	s := &ServerSettings{
+		K8sClient:   (&fakeKubeAPI{}).client(t),
+		Namespace:   "promecieus",
+		Exposer:     newProxyExposer(exposureBase{}, "promecieus"),
+		Grafana:     grafana,
+		Datasources: map[string]int{"owner": 42},
+		Annotations: map[string][]int{},
+		References:  &InstanceReferences{},
+	}
+	s.References.add("owner", "owner")
+	s.References.add("follower", "owner")
+	conn, messages := wsPair(t)
+
+	s.removeProm(context.Background(), conn, "follower")
+	if m := nextMessage(t, messages, "done"); !strings.Contains(m.Message, "kept running") {
+		t.Errorf("expected instance to be kept for the owner, got %+v", m)
+	}
+	if len(*grafanaRequests) != 0 {
+		t.Fatalf("expected instance not to be removed by the follower, got %q", *grafanaRequests)
+	}
+
+	s.removeProm(context.Background(), conn, "owner")
+	if m := nextMessage(t, messages, "done"); m.Message != "Prometheus instance removed" {
+		t.Errorf("expected instance to be removed by the last user, got %+v", m)
+	}
+	if len(*grafanaRequests) != 1 || (*grafanaRequests)[0] != "DELETE /api/datasources/42" {
+		t.Errorf("expected datasource to be removed with the instance, got %q", *grafanaRequests)
+	}
+}
+
+func TestStartPrometheusValidatesWhenReusedInstanceIsGone(t *testing.T) {
+	server := archiveServer(map[string][]byte{})
+	defer server.Close()
+	s := &ServerSettings{
+		K8sClient:  (&fakeKubeAPI{}).client(t),
+		Namespace:  "promecieus",
+		Fetcher:    testFetcher(),
+		Instances:  &InstanceStreams{},
+		References: &InstanceReferences{},
+		Creations:  &PendingCreations{},
+	}
+	conn, messages := wsPair(t)
+	// Archives were not validated as an instance was running when they were resolved
+	prowInfo := ProwInfo{MetricsURL: server.URL + "/" + promTarPath}
+
+	s.startPrometheus(context.Background(), conn, "abcde", prowInfo, true)
+	if m := nextMessage(t, messages, "status"); !strings.Contains(m.Message, "deploying abcde instead") {
+		t.Errorf("expected a new instance to be deployed, got %+v", m)
+	}
+	if m := nextMessage(t, messages, "failure"); !strings.HasPrefix(m.Message, "Failed to find metrics archive") {
+		t.Errorf("expected archives to be validated, got %+v", m)
+	}
+	if s.Instances.starting(prowInfo.archiveHash()) {
+		t.Error("expected stream to be removed after validation failed")
+	}
+}